@@ -0,0 +1,257 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ontariosystems/ira-controller/internal/util"
+)
+
+const (
+	// helperCertificateFile, helperPrivateKeyFile and helperIntermediatesFile are the files of the certificate secret
+	// mounted in the credential helper container
+	helperCertificateFile   = "tls.crt"
+	helperPrivateKeyFile    = "tls.key"
+	helperIntermediatesFile = "ca.crt"
+
+	// regionPlaceholder is replaced by the region of the credential helper in the IAM Roles Anywhere endpoints
+	regionPlaceholder = "{region}"
+)
+
+var (
+	// CredentialHelperRegion is the region the credential helper obtains credentials from when a pod doesn't specify
+	// one, the region of the trust anchor is used when it is empty
+	CredentialHelperRegion string
+	// CredentialHelperEndpoint is the IAM Roles Anywhere endpoint used when a pod doesn't specify one and
+	// CredentialHelperEndpoints doesn't have one for its region or partition, the endpoint of the region is used when
+	// it is empty
+	CredentialHelperEndpoint string
+	// CredentialHelperEndpoints are the IAM Roles Anywhere endpoints (e.g. FIPS or VPC interface endpoints) used for
+	// the regions or partitions of the trust anchors as a comma separated list of region=endpoint or
+	// partition=endpoint pairs.  The endpoint of a region takes precedence over the one of its partition.
+	CredentialHelperEndpoints string
+	// CredentialHelperWithProxy makes the credential helper use the proxy of its environment unless a pod disables it
+	CredentialHelperWithProxy bool
+	// CredentialHelperDebug enables the debug logging of the credential helper unless a pod disables it
+	CredentialHelperDebug bool
+	// CredentialHelperIntermediates makes the credential helper send the CA certificate of the certificate secret as
+	// an intermediate certificate unless a pod disables it
+	CredentialHelperIntermediates bool
+	// CredentialHelperNoVerifySSL disables the verification of the TLS certificate of the IAM Roles Anywhere endpoint.
+	// It can't be enabled by pods.
+	CredentialHelperNoVerifySSL bool
+
+	// booleanAnnotations are the annotations enabling or disabling an option of the credential helper
+	booleanAnnotations = []string{"ira.ontsys.com/debug", "ira.ontsys.com/intermediates", "ira.ontsys.com/with-proxy"}
+	// regionPattern matches the names of the AWS regions (e.g. us-east-1 or us-gov-west-1)
+	regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	// partitionPattern matches the names of the AWS partitions (e.g. aws or aws-us-gov)
+	partitionPattern = regexp.MustCompile(`^aws(-[a-z]+)*$`)
+	// roleSessionNamePattern matches the role session names accepted by STS
+	roleSessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+)
+
+// credentialOptions are the options of the aws_signing_helper commands obtaining credentials
+type credentialOptions struct {
+	Certificate     string
+	PrivateKey      string
+	Intermediates   string
+	TrustAnchorArn  string
+	ProfileArn      string
+	RoleArn         string
+	SessionDuration int
+	Region          string
+	Endpoint        string
+	RoleSessionName string
+	WithProxy       bool
+	Debug           bool
+	NoVerifySSL     bool
+}
+
+// serveOptions are the options of the aws_signing_helper serve command
+type serveOptions struct {
+	credentialOptions
+	Port int
+}
+
+// args returns the arguments of the options, leaving out the options that aren't set so that the credential helper
+// uses its defaults
+func (o credentialOptions) args() []string {
+	args := []string{
+		"--certificate", o.Certificate,
+		"--private-key", o.PrivateKey,
+		"--trust-anchor-arn", o.TrustAnchorArn,
+		"--profile-arn", o.ProfileArn,
+		"--role-arn", o.RoleArn,
+	}
+	args = appendValue(args, "--intermediates", o.Intermediates)
+	if o.SessionDuration != 0 {
+		args = append(args, "--session-duration", strconv.Itoa(o.SessionDuration))
+	}
+	args = appendValue(args, "--region", o.Region)
+	args = appendValue(args, "--endpoint", o.Endpoint)
+	args = appendValue(args, "--role-session-name", o.RoleSessionName)
+	args = appendFlag(args, "--with-proxy", o.WithProxy)
+	args = appendFlag(args, "--debug", o.Debug)
+	args = appendFlag(args, "--no-verify-ssl", o.NoVerifySSL)
+	return args
+}
+
+// args returns the arguments of the serve command, including the command itself
+func (o serveOptions) args() []string {
+	args := append([]string{"serve"}, o.credentialOptions.args()...)
+	return append(args, "--port", strconv.Itoa(o.Port))
+}
+
+// appendValue appends the option with its value to the arguments unless the value is empty
+func appendValue(args []string, option string, value string) []string {
+	if value == "" {
+		return args
+	}
+	return append(args, option, value)
+}
+
+// appendFlag appends the option to the arguments when it is enabled
+func appendFlag(args []string, option string, enabled bool) []string {
+	if !enabled {
+		return args
+	}
+	return append(args, option)
+}
+
+// credentialOptions returns the options used by the credential helper to obtain credentials for the pod
+func (h *helperConfig) credentialOptions() credentialOptions {
+	o := credentialOptions{
+		Certificate:     h.certMountPath() + "/" + helperCertificateFile,
+		PrivateKey:      h.certMountPath() + "/" + helperPrivateKeyFile,
+		TrustAnchorArn:  h.annotations["ira.ontsys.com/trust-anchor"],
+		ProfileArn:      h.annotations["ira.ontsys.com/profile"],
+		RoleArn:         h.annotations["ira.ontsys.com/role"],
+		SessionDuration: h.sessionDuration,
+		Region:          h.region(),
+		Endpoint:        h.rolesAnywhereEndpoint(),
+		RoleSessionName: annotationOrDefault(h.annotations, "ira.ontsys.com/role-session-name", h.roleSessionName),
+		WithProxy:       booleanOrDefault(h.annotations, "ira.ontsys.com/with-proxy", CredentialHelperWithProxy),
+		Debug:           booleanOrDefault(h.annotations, "ira.ontsys.com/debug", CredentialHelperDebug),
+		NoVerifySSL:     CredentialHelperNoVerifySSL,
+	}
+	if booleanOrDefault(h.annotations, "ira.ontsys.com/intermediates", CredentialHelperIntermediates) {
+		o.Intermediates = h.certMountPath() + "/" + helperIntermediatesFile
+	}
+	return o
+}
+
+// serveOptions returns the options of the credential helper serving credentials to the containers of the pod
+func (h *helperConfig) serveOptions() serveOptions {
+	return serveOptions{
+		credentialOptions: h.credentialOptions(),
+		Port:              h.port,
+	}
+}
+
+// region returns the region the credential helper obtains credentials from, which defaults to the region of the trust
+// anchor
+func (h *helperConfig) region() string {
+	if region := annotationOrDefault(h.annotations, "ira.ontsys.com/region", CredentialHelperRegion); region != "" {
+		return region
+	}
+	if trustAnchor, err := util.ParseArn(h.annotations["ira.ontsys.com/trust-anchor"]); err == nil {
+		return trustAnchor.Region
+	}
+	return ""
+}
+
+// rolesAnywhereEndpoint returns the IAM Roles Anywhere endpoint used by the credential helper, which is looked up by
+// region and then by the partition of the trust anchor when the pod doesn't specify one.  The credential helper uses
+// the endpoint of its region when it is empty.
+func (h *helperConfig) rolesAnywhereEndpoint() string {
+	region := h.region()
+	endpoint := h.annotations["ira.ontsys.com/endpoint"]
+	if endpoint == "" {
+		// the endpoints are validated at startup
+		endpoints, _ := ParseEndpoints(CredentialHelperEndpoints)
+		endpoint = endpoints[region]
+		if trustAnchor, err := util.ParseArn(h.annotations["ira.ontsys.com/trust-anchor"]); endpoint == "" && err == nil {
+			endpoint = endpoints[trustAnchor.Partition]
+		}
+		if endpoint == "" {
+			endpoint = CredentialHelperEndpoint
+		}
+	}
+	return strings.ReplaceAll(endpoint, regionPlaceholder, region)
+}
+
+// ParseEndpoints parses a comma separated list of region=endpoint or partition=endpoint pairs into the endpoints keyed
+// by region or partition
+func ParseEndpoints(value string) (map[string]string, error) {
+	endpoints := make(map[string]string)
+	if value == "" {
+		return endpoints, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, endpoint, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || (!regionPattern.MatchString(key) && !partitionPattern.MatchString(key)) {
+			return nil, fmt.Errorf("endpoint %q is invalid, it must be in the form region=endpoint or partition=endpoint", pair)
+		}
+		if err := validateEndpoint(endpoint); err != nil {
+			return nil, fmt.Errorf("endpoint of %s %q is invalid, it %w", key, endpoint, err)
+		}
+		endpoints[key] = endpoint
+	}
+	return endpoints, nil
+}
+
+// booleanOrDefault returns whether the boolean annotation is enabled, falling back to the default when the annotation
+// isn't provided
+func booleanOrDefault(annotations map[string]string, annotation string, defaultValue bool) bool {
+	if value, ok := annotations[annotation]; ok && value != "" {
+		return value == "true"
+	}
+	return defaultValue
+}
+
+// validateRegion verifies that the value is the name of an AWS region
+func validateRegion(region string) error {
+	if !regionPattern.MatchString(region) {
+		return errors.New("must be the name of an AWS region (e.g. us-east-1)")
+	}
+	return nil
+}
+
+// validateEndpoint verifies that the value is the URL of an IAM Roles Anywhere endpoint, which may contain the region
+// placeholder
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(strings.ReplaceAll(endpoint, regionPlaceholder, "us-east-1"))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("must be an http or https URL (e.g. https://rolesanywhere.us-east-1.amazonaws.com)")
+	}
+	return nil
+}
+
+// validateRoleSessionName verifies that the value is a role session name accepted by STS
+func validateRoleSessionName(name string) error {
+	if !roleSessionNamePattern.MatchString(name) {
+		return fmt.Errorf("must be 2 to 64 characters consisting of letters, digits and %q", "+=,.@_-")
+	}
+	return nil
+}
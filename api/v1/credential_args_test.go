@@ -0,0 +1,140 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"maps"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Credential helper arguments", func() {
+	newHelper := func(mode string, annotations map[string]string) *helperConfig {
+		resolved := map[string]string{
+			"ira.ontsys.com/trust-anchor": trustAnchorArn,
+			"ira.ontsys.com/profile":      profileArn,
+			"ira.ontsys.com/role":         roleArn,
+		}
+		maps.Copy(resolved, annotations)
+		return &helperConfig{
+			annotations:     resolved,
+			mode:            mode,
+			port:            9911,
+			sessionDuration: 900,
+		}
+	}
+	AfterEach(func() {
+		CredentialHelperRegion = ""
+		CredentialHelperEndpoint = ""
+		CredentialHelperEndpoints = ""
+		CredentialHelperWithProxy = false
+		CredentialHelperDebug = false
+		CredentialHelperIntermediates = false
+		CredentialHelperNoVerifySSL = false
+	})
+
+	It("should only pass the required options by default", func() {
+		Expect(newHelper(ImdsMode, map[string]string{}).serveOptions().args()).To(HaveExactElements(
+			"serve",
+			"--certificate", "/ira-cert/tls.crt",
+			"--private-key", "/ira-cert/tls.key",
+			"--trust-anchor-arn", trustAnchorArn,
+			"--profile-arn", profileArn,
+			"--role-arn", roleArn,
+			"--session-duration", "900",
+			"--region", "us-east-1",
+			"--port", "9911",
+		))
+	})
+	It("should pass the options provided by the flags", func() {
+		CredentialHelperRegion = "us-west-2"
+		CredentialHelperEndpoint = "https://rolesanywhere.example.com"
+		CredentialHelperWithProxy = true
+		CredentialHelperDebug = true
+		CredentialHelperIntermediates = true
+		CredentialHelperNoVerifySSL = true
+		Expect(newHelper(ProcessMode, map[string]string{}).credentialOptions().args()).To(HaveExactElements(
+			"--certificate", "/ira-cert/tls.crt",
+			"--private-key", "/ira-cert/tls.key",
+			"--trust-anchor-arn", trustAnchorArn,
+			"--profile-arn", profileArn,
+			"--role-arn", roleArn,
+			"--intermediates", "/ira-cert/ca.crt",
+			"--session-duration", "900",
+			"--region", "us-west-2",
+			"--endpoint", "https://rolesanywhere.example.com",
+			"--with-proxy",
+			"--debug",
+			"--no-verify-ssl",
+		))
+	})
+	It("should prefer the options provided by the annotations", func() {
+		CredentialHelperRegion = "us-west-2"
+		CredentialHelperDebug = true
+		Expect(newHelper(ImdsMode, map[string]string{
+			"ira.ontsys.com/region":            "eu-west-1",
+			"ira.ontsys.com/role-session-name": "my-session",
+			"ira.ontsys.com/with-proxy":        "true",
+			"ira.ontsys.com/debug":             "false",
+			"ira.ontsys.com/intermediates":     "true",
+		}).serveOptions().args()).To(HaveExactElements(
+			"serve",
+			"--certificate", "/ira-cert/tls.crt",
+			"--private-key", "/ira-cert/tls.key",
+			"--trust-anchor-arn", trustAnchorArn,
+			"--profile-arn", profileArn,
+			"--role-arn", roleArn,
+			"--intermediates", "/ira-cert/ca.crt",
+			"--session-duration", "900",
+			"--region", "eu-west-1",
+			"--role-session-name", "my-session",
+			"--with-proxy",
+			"--port", "9911",
+		))
+	})
+	It("should use the endpoint of the region or partition of the trust anchor", func() {
+		CredentialHelperEndpoint = "https://rolesanywhere.example.com"
+		CredentialHelperEndpoints = "aws=https://rolesanywhere-fips.{region}.amazonaws.com,eu-west-1=https://vpce-1.rolesanywhere.eu-west-1.vpce.amazonaws.com"
+		Expect(newHelper(ImdsMode, map[string]string{}).credentialOptions()).To(And(
+			HaveField("Region", "us-east-1"),
+			HaveField("Endpoint", "https://rolesanywhere-fips.us-east-1.amazonaws.com"),
+		))
+		Expect(newHelper(ImdsMode, map[string]string{
+			"ira.ontsys.com/region": "eu-west-1",
+		}).credentialOptions()).To(HaveField("Endpoint", "https://vpce-1.rolesanywhere.eu-west-1.vpce.amazonaws.com"))
+		Expect(newHelper(ImdsMode, map[string]string{
+			"ira.ontsys.com/trust-anchor": "arn:aws-us-gov:rolesanywhere:us-gov-west-1:123456789012:trust-anchor/ta",
+		}).credentialOptions()).To(HaveField("Endpoint", "https://rolesanywhere.example.com"))
+	})
+	It("should set the region of the containers unless they define it", func() {
+		container := v1.Container{
+			Env: []v1.EnvVar{
+				{
+					Name:  "AWS_REGION",
+					Value: "eu-west-1",
+				},
+			},
+		}
+		newHelper(ImdsMode, map[string]string{}).containerConfig().applyTo(&container)
+		Expect(container.Env).To(ContainElements(
+			v1.EnvVar{Name: "AWS_REGION", Value: "eu-west-1"},
+			v1.EnvVar{Name: "AWS_DEFAULT_REGION", Value: "us-east-1"},
+		))
+	})
+})
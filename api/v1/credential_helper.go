@@ -0,0 +1,486 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ontariosystems/ira-controller/internal/util"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// maxPortAttempts is the number of ports after the default port that are tried when the default port is in use
+	maxPortAttempts = 100
+
+	// AutoSidecarMode chooses between the native and classic sidecar modes based on the version of the cluster
+	AutoSidecarMode = "auto"
+	// NativeSidecarMode injects the credential helper as an init container with a restart policy of Always
+	NativeSidecarMode = "native"
+	// ClassicSidecarMode injects the credential helper as a regular container for clusters without native sidecars
+	ClassicSidecarMode = "classic"
+
+	// MinIamSessionDuration and MaxIamSessionDuration are the bounds, in seconds, IAM enforces on the duration of role
+	// sessions
+	MinIamSessionDuration = 900
+	MaxIamSessionDuration = 43200
+)
+
+var (
+	// SidecarModes are the supported ways of injecting the credential helper sidecar
+	SidecarModes = []string{AutoSidecarMode, NativeSidecarMode, ClassicSidecarMode}
+	// SidecarMode is the way the credential helper sidecar is injected, auto is resolved at startup
+	SidecarMode string
+	// CredentialHelperPort is the port the credential helper listens on unless the pod requests another one or it is in use
+	CredentialHelperPort int
+	// HostNetworkPortRange is the range of ports (e.g. 30000-30999) the credential helper ports of pods using the
+	// host network are allocated from.  Pods using the host network are denied when it is empty.
+	HostNetworkPortRange string
+	// CredentialHelperMinCpu, CredentialHelperMaxCpu, CredentialHelperMinMemory and CredentialHelperMaxMemory bound the
+	// requests and limits of the credential helper, the resource isn't bounded when they are empty
+	CredentialHelperMinCpu    string
+	CredentialHelperMaxCpu    string
+	CredentialHelperMinMemory string
+	CredentialHelperMaxMemory string
+	// MinSessionDuration and MaxSessionDuration bound the duration, in seconds, of the credentials obtained by the
+	// credential helper
+	MinSessionDuration = MinIamSessionDuration
+	MaxSessionDuration = MaxIamSessionDuration
+
+	// resourceAnnotations are the annotations setting the requests and limits of the credential helper mapped to the
+	// resource they set
+	resourceAnnotations = map[string]v1.ResourceName{
+		"ira.ontsys.com/cpu-limit":      v1.ResourceCPU,
+		"ira.ontsys.com/cpu-request":    v1.ResourceCPU,
+		"ira.ontsys.com/memory-limit":   v1.ResourceMemory,
+		"ira.ontsys.com/memory-request": v1.ResourceMemory,
+	}
+)
+
+// helperConfig is the resolved configuration of the credential helper injected into a pod
+type helperConfig struct {
+	annotations map[string]string
+	classic     bool
+	first       bool
+	// hostNetwork reports whether the pod uses the host network, in which case the port of the credential helper is
+	// shared with the other pods on the node
+	hostNetwork bool
+	mode        string
+	port        int
+	// adapterPort is the port the credential adapter listens on in the container mode
+	adapterPort     int
+	resources       v1.ResourceRequirements
+	sessionDuration int
+	// roleSessionName is the role session name rendered from the template for the pod
+	roleSessionName string
+	// name is the name of the additional role of the credential helper, which is empty for the primary role of the pod
+	name string
+}
+
+// newHelperConfig resolves the configuration of the credential helper for the pod from its annotations and the
+// configured defaults
+func newHelperConfig(pod *v1.Pod, annotations map[string]string, seed string) (*helperConfig, error) {
+	mode, err := credentialMode(annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := helperResources(annotations)
+	if err != nil {
+		return nil, err
+	}
+	var sessionDuration int
+	if value := annotationOrDefault(annotations, "ira.ontsys.com/session-duration", SessionDuration); value != "" {
+		if sessionDuration, err = parseSessionDuration(value); err != nil {
+			return nil, fmt.Errorf("ira.ontsys.com/session-duration %q is invalid, it %w", value, err)
+		}
+	}
+
+	h := &helperConfig{
+		annotations:     annotations,
+		classic:         SidecarMode == ClassicSidecarMode,
+		first:           annotations["ira.ontsys.com/init-containers"] == "true",
+		hostNetwork:     pod.Spec.HostNetwork,
+		mode:            mode,
+		resources:       resources,
+		sessionDuration: sessionDuration,
+	}
+	if h.classic && h.mode != ProcessMode {
+		if !slices.Contains([]v1.RestartPolicy{"", v1.RestartPolicyAlways}, pod.Spec.RestartPolicy) {
+			// a sidecar running as a regular container would keep a batch pod from ever completing
+			podlog.Info("Using the process credential mode for pod that doesn't restart", "pod name", pod.Name, "pod namespace", pod.Namespace, "pod generate name", pod.GenerateName)
+			h.mode = ProcessMode
+		} else if h.first {
+			return nil, fmt.Errorf("ira.ontsys.com/init-containers requires the %s credential mode when native sidecars aren't used", ProcessMode)
+		}
+	}
+	if h.mode != ProcessMode {
+		if h.port, err = helperPort(pod, annotations, seed); err != nil {
+			return nil, err
+		}
+	}
+	if h.mode == ContainerMode {
+		if CredentialAdapterImage == "" {
+			return nil, fmt.Errorf("the %s credential mode requires the credential adapter image to be configured", ContainerMode)
+		}
+		used := usedPorts(pod, annotations)
+		used[h.port] = h.containerName()
+		if h.adapterPort, err = nextFreePort(pod, used, h.port+1); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// newHelperConfigs resolves the configuration of the credential helper of the primary role of the pod followed by those
+// of its additional roles.  The credential helper of each additional role listens on the first free port after the
+// port of the credential helper before it.
+func newHelperConfigs(pod *v1.Pod, annotations map[string]string, seed string) ([]*helperConfig, error) {
+	roles, err := util.AdditionalRoles(annotations)
+	if err != nil {
+		return nil, err
+	}
+	helper, err := newHelperConfig(pod, annotations, seed)
+	if err != nil {
+		return nil, err
+	}
+	helpers := []*helperConfig{helper}
+	// the credential adapters are named after the credential helpers, so they may conflict with those of other roles
+	names := sets.New[string]()
+	injectedNames := func(h *helperConfig) []string {
+		if h.mode == ContainerMode {
+			return h.containerNames()
+		}
+		return []string{h.containerName()}
+	}
+	names.Insert(injectedNames(helper)...)
+	used := usedPorts(pod, annotations)
+	for _, role := range roles {
+		roleAnnotations := role.Annotations(annotations)
+		if previous := helpers[len(helpers)-1]; previous.port != 0 {
+			used[previous.port] = previous.containerName()
+			if previous.adapterPort != 0 {
+				used[previous.adapterPort] = previous.adapterContainerName()
+			}
+			port, err := nextFreePort(pod, used, max(previous.port, previous.adapterPort)+1)
+			if err != nil {
+				return nil, err
+			}
+			roleAnnotations["ira.ontsys.com/port"] = strconv.Itoa(port)
+		}
+		if helper, err = newHelperConfig(pod, roleAnnotations, seed); err != nil {
+			return nil, fmt.Errorf("role %q in %s is invalid: %w", role.Name, util.RolesAnnotation, err)
+		}
+		helper.name = role.Name
+		for _, name := range injectedNames(helper) {
+			if names.Has(name) {
+				return nil, fmt.Errorf("role %q in %s is invalid: the container name %q of its credential helper is already used by another credential helper", role.Name, util.RolesAnnotation, name)
+			}
+			names.Insert(name)
+		}
+		helpers = append(helpers, helper)
+	}
+	return helpers, nil
+}
+
+// sidecar reports whether the credential helper is injected as a regular container rather than an init container
+func (h *helperConfig) sidecar() bool {
+	return h.classic && h.mode != ProcessMode
+}
+
+// suffix returns the suffix of the names of the container, volume and files of the credential helper, which keeps those
+// of the credential helpers of additional roles apart from those of the primary role
+func (h *helperConfig) suffix() string {
+	if h.name == "" {
+		return ""
+	}
+	return "-" + h.name
+}
+
+// helperContainerNames returns the names of the credential helper and credential adapter containers of the primary and
+// additional roles, ignoring an invalid ira.ontsys.com/roles annotation
+func helperContainerNames(annotations map[string]string) sets.Set[string] {
+	names := sets.New((&helperConfig{}).containerNames()...)
+	roles, _ := util.AdditionalRoles(annotations)
+	for _, role := range roles {
+		names.Insert((&helperConfig{name: role.Name}).containerNames()...)
+	}
+	return names
+}
+
+// containerName returns the name of the credential helper container
+func (h *helperConfig) containerName() string {
+	return helperContainerName + h.suffix()
+}
+
+// adapterContainerName returns the name of the credential adapter container used in the container mode
+func (h *helperConfig) adapterContainerName() string {
+	return h.containerName() + adapterContainerSuffix
+}
+
+// containerNames returns the names reserved for the containers of the credential helper, whether or not the credential
+// mode uses a credential adapter
+func (h *helperConfig) containerNames() []string {
+	return []string{h.containerName(), h.adapterContainerName()}
+}
+
+// certVolumeName returns the name of the volume holding the certificate of the credential helper
+func (h *helperConfig) certVolumeName() string {
+	return certVolumeName + h.suffix()
+}
+
+// certMountPath returns the directory the certificate of the credential helper is mounted in
+func (h *helperConfig) certMountPath() string {
+	return certMountPath + h.suffix()
+}
+
+// configFile returns the AWS config file installed for the credential helper in the process mode
+func (h *helperConfig) configFile() string {
+	return configMountPath + "/config" + h.suffix()
+}
+
+// helperResources returns the resource requirements of the credential helper, verifying that each of them is within
+// the configured bounds and that the requests don't exceed the limits
+func helperResources(annotations map[string]string) (v1.ResourceRequirements, error) {
+	resources := v1.ResourceRequirements{
+		Limits:   v1.ResourceList{},
+		Requests: v1.ResourceList{},
+	}
+	for _, r := range []struct {
+		annotation   string
+		defaultValue string
+		list         v1.ResourceList
+	}{
+		{"ira.ontsys.com/cpu-request", CredentialHelperCpuRequest, resources.Requests},
+		{"ira.ontsys.com/cpu-limit", CredentialHelperCpuLimit, resources.Limits},
+		{"ira.ontsys.com/memory-request", CredentialHelperMemoryRequest, resources.Requests},
+		{"ira.ontsys.com/memory-limit", CredentialHelperMemoryLimit, resources.Limits},
+	} {
+		value := annotationOrDefault(annotations, r.annotation, r.defaultValue)
+		if value == "" {
+			continue
+		}
+		quantity, err := helperQuantity(r.annotation, value)
+		if err != nil {
+			return resources, fmt.Errorf("%s %q is invalid, it %w", r.annotation, value, err)
+		}
+		r.list[resourceAnnotations[r.annotation]] = quantity
+	}
+	for name, request := range resources.Requests {
+		if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return resources, fmt.Errorf("the %s request of the credential helper (%s) must not exceed its limit (%s)", name, request.String(), limit.String())
+		}
+	}
+	return resources, nil
+}
+
+// helperQuantity parses the quantity of a resource annotation and verifies that it is within the configured bounds of
+// the resource
+func helperQuantity(annotation string, value string) (resource.Quantity, error) {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() < 0 {
+		return quantity, errors.New("must be a non-negative quantity (e.g. 250m or 64Mi)")
+	}
+	minimum, maximum := CredentialHelperMinCpu, CredentialHelperMaxCpu
+	if resourceAnnotations[annotation] == v1.ResourceMemory {
+		minimum, maximum = CredentialHelperMinMemory, CredentialHelperMaxMemory
+	}
+	if minimum != "" && quantity.Cmp(resource.MustParse(minimum)) < 0 {
+		return quantity, fmt.Errorf("must be at least %s", minimum)
+	}
+	if maximum != "" && quantity.Cmp(resource.MustParse(maximum)) > 0 {
+		return quantity, fmt.Errorf("must be at most %s", maximum)
+	}
+	return quantity, nil
+}
+
+// parseSessionDuration parses the duration, in seconds, of the credentials obtained by the credential helper and
+// verifies that it is within the configured bounds
+func parseSessionDuration(value string) (int, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("must be a number of seconds")
+	}
+	if seconds < MinSessionDuration || seconds > MaxSessionDuration {
+		return 0, fmt.Errorf("must be between %d and %d seconds", MinSessionDuration, MaxSessionDuration)
+	}
+	return seconds, nil
+}
+
+// ValidateHelperDefaults verifies that the configured bounds are valid, that the default resources and session
+// duration of the credential helper are within them and that its default region and endpoint are valid, so that
+// invalid flags are reported at startup
+func ValidateHelperDefaults() error {
+	for _, bound := range []string{CredentialHelperMinCpu, CredentialHelperMaxCpu, CredentialHelperMinMemory, CredentialHelperMaxMemory} {
+		if quantity, err := resource.ParseQuantity(bound); bound != "" && (err != nil || quantity.Sign() < 0) {
+			return fmt.Errorf("resource bound %q must be a non-negative quantity (e.g. 250m or 64Mi)", bound)
+		}
+	}
+	if MinSessionDuration < MinIamSessionDuration || MaxSessionDuration > MaxIamSessionDuration || MinSessionDuration > MaxSessionDuration {
+		return fmt.Errorf("session duration bounds must be between %d and %d seconds", MinIamSessionDuration, MaxIamSessionDuration)
+	}
+	if _, err := helperResources(nil); err != nil {
+		return err
+	}
+	if SessionDuration != "" {
+		if _, err := parseSessionDuration(SessionDuration); err != nil {
+			return fmt.Errorf("session duration %q is invalid, it %w", SessionDuration, err)
+		}
+	}
+	if CredentialHelperRegion != "" {
+		if err := validateRegion(CredentialHelperRegion); err != nil {
+			return fmt.Errorf("region %q is invalid, it %w", CredentialHelperRegion, err)
+		}
+	}
+	if CredentialHelperEndpoint != "" {
+		if err := validateEndpoint(CredentialHelperEndpoint); err != nil {
+			return fmt.Errorf("endpoint %q is invalid, it %w", CredentialHelperEndpoint, err)
+		}
+	}
+	if _, err := ParseEndpoints(CredentialHelperEndpoints); err != nil {
+		return err
+	}
+	return nil
+}
+
+// annotationOrDefault returns the value of the annotation if it is present, otherwise the default value
+func annotationOrDefault(annotations map[string]string, annotation string, defaultValue string) string {
+	if util.MapContains(annotations, annotation) {
+		return annotations[annotation]
+	}
+	return defaultValue
+}
+
+// helperPort returns the port the credential helper should listen on.  A port requested with the ira.ontsys.com/port
+// annotation must not be used by any of the containers, otherwise the first free port starting at the configured
+// default is used.  Pods using the host network share the node's loopback interface with every other pod using it, so
+// their port is allocated from the host network port range starting at an offset derived from the pod name (or the
+// seed when the name is generated).
+func helperPort(pod *v1.Pod, annotations map[string]string, seed string) (int, error) {
+	used := usedPorts(pod, annotations)
+
+	if util.MapContains(annotations, "ira.ontsys.com/port") {
+		port, err := strconv.Atoi(annotations["ira.ontsys.com/port"])
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("port %q in ira.ontsys.com/port is invalid, it must be a number between 1 and 65535", annotations["ira.ontsys.com/port"])
+		}
+		if container, ok := used[port]; ok {
+			return 0, fmt.Errorf("port %d in ira.ontsys.com/port is already used by container %q", port, container)
+		}
+		return port, nil
+	}
+
+	if pod.Spec.HostNetwork {
+		if HostNetworkPortRange == "" {
+			return 0, errors.New("pods using the host network require a port to be chosen with ira.ontsys.com/port")
+		}
+		first, last, err := ParsePortRange(HostNetworkPortRange)
+		if err != nil {
+			return 0, err
+		}
+		if pod.Name != "" {
+			seed = pod.Namespace + "/" + pod.Name
+		}
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(seed))
+		size := last - first + 1
+		offset := int(hash.Sum32() % uint32(size))
+		for i := 0; i < size; i++ {
+			port := first + (offset+i)%size
+			if _, ok := used[port]; !ok {
+				return port, nil
+			}
+		}
+		return 0, fmt.Errorf("unable to find a free port for the IRA credential helper in the host network port range %s", HostNetworkPortRange)
+	}
+
+	for port := CredentialHelperPort; port < CredentialHelperPort+maxPortAttempts && port <= 65535; port++ {
+		if _, ok := used[port]; !ok {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to find a free port for the IRA credential helper starting at %d, use ira.ontsys.com/port to choose one", CredentialHelperPort)
+}
+
+// nextFreePort returns the first port from the start that isn't used.  The ports of pods using the host network wrap
+// around within the host network port range.
+func nextFreePort(pod *v1.Pod, used map[int]string, start int) (int, error) {
+	first, last := start, min(start+maxPortAttempts-1, 65535)
+	if pod.Spec.HostNetwork && HostNetworkPortRange != "" {
+		rangeFirst, rangeLast, err := ParsePortRange(HostNetworkPortRange)
+		if err != nil {
+			return 0, err
+		}
+		if start-1 >= rangeFirst && start-1 <= rangeLast {
+			first, last = rangeFirst, rangeLast
+		}
+	}
+	size := last - first + 1
+	for i := 0; i < size; i++ {
+		port := first + (start-first+i)%size
+		if _, ok := used[port]; !ok {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to find a free port for the IRA credential helper of an additional role or credential adapter after port %d", start-1)
+}
+
+// ParsePortRange parses a port range in the form first-last
+func ParsePortRange(portRange string) (first int, last int, err error) {
+	bounds := strings.Split(portRange, "-")
+	if len(bounds) == 2 {
+		first, err = strconv.Atoi(bounds[0])
+		if err == nil {
+			last, err = strconv.Atoi(bounds[1])
+		}
+	}
+	if len(bounds) != 2 || err != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("port range %q is invalid, it must be in the form first-last with ports between 1 and 65535", portRange)
+	}
+	return first, last, nil
+}
+
+// usedPorts returns the ports, mapped to the name of the container using them, that are either declared by the
+// containers or that appear in their commands or arguments.  The credential helpers are skipped so that they are given
+// the same ports when the pod is admitted again.
+func usedPorts(pod *v1.Pod, annotations map[string]string) map[int]string {
+	used := make(map[int]string)
+	helpers := helperContainerNames(annotations)
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		if helpers.Has(c.Name) {
+			continue
+		}
+		for _, p := range c.Ports {
+			used[int(p.ContainerPort)] = c.Name
+		}
+		for _, arg := range slices.Concat(c.Command, c.Args) {
+			for _, field := range strings.FieldsFunc(arg, func(r rune) bool { return strings.ContainsRune("=:, ", r) }) {
+				if port, err := strconv.Atoi(field); err == nil {
+					used[port] = c.Name
+				}
+			}
+		}
+	}
+	return used
+}
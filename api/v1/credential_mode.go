@@ -0,0 +1,427 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ontariosystems/ira-controller/internal/util"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ImdsMode configures the containers to use the credential helper as an emulated EC2 instance metadata service
+	ImdsMode = "imds"
+	// ContainerMode configures the containers to use a credential adapter, which serves the credentials of the
+	// credential helper, as a container credentials provider
+	ContainerMode = "container"
+	// ProcessMode configures the containers to run the credential helper as a credential_process from an AWS config file
+	ProcessMode = "process"
+
+	// CredentialAdapterCommand is the command of the controller binary running the credential adapter
+	CredentialAdapterCommand = "credential-adapter"
+	// adapterBinary is the path of the controller binary in the credential adapter image
+	adapterBinary = "/ira-controller"
+	// adapterContainerSuffix is appended to the name of the credential helper container to name its credential adapter
+	adapterContainerSuffix = "-adapter"
+
+	// configVolumeName is the name of the volume the credential helper and AWS config file are installed in
+	configVolumeName = "ira-config"
+	// configMountPath is the directory the credential helper and AWS config file are installed in
+	configMountPath = "/ira"
+	// tokenVolumeName is the name of the projected volume holding the token authorizing the requests for credentials
+	// sent to the credential adapter
+	tokenVolumeName = "ira-token"
+	// tokenMountPath is the directory the authorization token is mounted in
+	tokenMountPath = "/var/run/secrets/ira.ontsys.com/serviceaccount"
+	// tokenAudience is the audience of the authorization token, which keeps it from being used with the API server
+	tokenAudience = "ira.ontsys.com"
+	// tokenExpirationSeconds is the lifetime of the authorization token, which the kubelet rotates
+	tokenExpirationSeconds = 3600
+
+	// startupProbePeriodSeconds, startupProbeTimeoutSeconds and startupProbeFailureThreshold give the credential helper
+	// two minutes to obtain credentials, e.g. while cert-manager issues the certificate, before it is restarted
+	startupProbePeriodSeconds    = 2
+	startupProbeTimeoutSeconds   = 10
+	startupProbeFailureThreshold = 60
+)
+
+var (
+	// CredentialModes are the supported ways of providing credentials to the containers
+	CredentialModes = []string{ImdsMode, ContainerMode, ProcessMode}
+	// CredentialHelperMode is the credential mode used when a pod doesn't specify one
+	CredentialHelperMode string
+	// CredentialAdapterImage is the image of the credential adapter injected in the container mode, pods can't use the
+	// container mode when it is empty
+	CredentialAdapterImage string
+)
+
+// containerConfig holds the environment variables and volume mounts that wire a container to the credential helper
+type containerConfig struct {
+	env []v1.EnvVar
+	// defaultEnv are the environment variables that are only added when the container doesn't define them
+	defaultEnv []v1.EnvVar
+	mounts     []v1.VolumeMount
+}
+
+// applyTo adds the environment variables and volume mounts to the container replacing any with the same name, except
+// for the default environment variables which don't replace those of the container
+func (cc containerConfig) applyTo(c *v1.Container) {
+	for _, env := range cc.env {
+		c.Env = upsertEnv(c.Env, env)
+	}
+	for _, env := range cc.defaultEnv {
+		if !slices.ContainsFunc(c.Env, func(e v1.EnvVar) bool { return e.Name == env.Name }) {
+			c.Env = append(c.Env, env)
+		}
+	}
+	for _, mount := range cc.mounts {
+		c.VolumeMounts = upsertVolumeMount(c.VolumeMounts, mount)
+	}
+}
+
+// credentialMode returns the credential mode for the pod from the ira.ontsys.com/credential-mode annotation falling
+// back to the configured default
+func credentialMode(annotations map[string]string) (string, error) {
+	mode := CredentialHelperMode
+	if util.MapContains(annotations, "ira.ontsys.com/credential-mode") {
+		mode = annotations["ira.ontsys.com/credential-mode"]
+	}
+	if mode == "" {
+		return ImdsMode, nil
+	}
+	if !slices.Contains(CredentialModes, mode) {
+		return "", fmt.Errorf("credential mode %q is invalid, it must be one of (%s)", mode, strings.Join(CredentialModes, ","))
+	}
+	return mode, nil
+}
+
+// containerConfig returns the configuration the containers need to obtain credentials from the credential helper and
+// to use them in the region of the credential helper
+func (h *helperConfig) containerConfig() containerConfig {
+	config := h.modeConfig()
+	if region := h.region(); region != "" {
+		config.defaultEnv = []v1.EnvVar{
+			{
+				Name:  "AWS_REGION",
+				Value: region,
+			},
+			{
+				Name:  "AWS_DEFAULT_REGION",
+				Value: region,
+			},
+		}
+	}
+	return config
+}
+
+// modeConfig returns the configuration the containers need to obtain credentials in the credential mode of the helper
+func (h *helperConfig) modeConfig() containerConfig {
+	if h.mode == ProcessMode {
+		return containerConfig{
+			env: []v1.EnvVar{
+				{
+					Name:  "AWS_CONFIG_FILE",
+					Value: h.configFile(),
+				},
+				{
+					Name:  "AWS_SDK_LOAD_CONFIG",
+					Value: "1",
+				},
+			},
+			mounts: []v1.VolumeMount{
+				{
+					Name:      configVolumeName,
+					MountPath: configMountPath,
+					ReadOnly:  true,
+				},
+				{
+					Name:      h.certVolumeName(),
+					MountPath: h.certMountPath(),
+					ReadOnly:  true,
+				},
+			},
+		}
+	}
+
+	if h.mode == ContainerMode {
+		return containerConfig{
+			env: []v1.EnvVar{
+				{
+					Name:  "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+					Value: fmt.Sprintf("http://127.0.0.1:%d/", h.adapterPort),
+				},
+				{
+					Name:  "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+					Value: tokenMountPath + "/token",
+				},
+			},
+			mounts: []v1.VolumeMount{tokenVolumeMount()},
+		}
+	}
+
+	return containerConfig{
+		env: []v1.EnvVar{
+			{
+				Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+				Value: h.metadataEndpoint(),
+			},
+		},
+	}
+}
+
+// container returns the credential helper container to inject.  In the process mode it is an init container installing
+// the credential helper and AWS config file, otherwise it is a sidecar serving credentials, either as a native sidecar
+// (an init container that is always restarted) or as a regular container when using classic sidecars.
+func (h *helperConfig) container() v1.Container {
+	if h.mode == ProcessMode {
+		return v1.Container{
+			Name:    h.containerName(),
+			Image:   h.image(),
+			Command: []string{"sh", "-c", installScript(h.configFile())},
+			Env: append(h.helperEnv(), v1.EnvVar{
+				Name:  "IRA_AWS_CONFIG",
+				Value: h.awsConfig(),
+			}),
+			Resources:       h.resources,
+			SecurityContext: helperSecurityContext(),
+			VolumeMounts: []v1.VolumeMount{
+				{
+					Name:      configVolumeName,
+					MountPath: configMountPath,
+				},
+			},
+		}
+	}
+
+	container := v1.Container{
+		Name:            h.containerName(),
+		Image:           h.image(),
+		Command:         []string{"aws_signing_helper"},
+		Args:            h.serveOptions().args(),
+		Env:             h.helperEnv(),
+		Resources:       h.resources,
+		SecurityContext: helperSecurityContext(),
+		VolumeMounts: []v1.VolumeMount{
+			{
+				Name:      h.certVolumeName(),
+				MountPath: h.certMountPath(),
+			},
+		},
+	}
+	h.configureSidecar(&container, h.port)
+	if !h.sidecar() {
+		container.StartupProbe = h.startupProbe()
+	}
+	return container
+}
+
+// injectedContainers returns the containers injected for the credential helper: the credential helper, with the sidecar
+// template of the namespace applied, followed by its credential adapter in the container mode
+func (h *helperConfig) injectedContainers(namespace string) ([]v1.Container, error) {
+	container, err := applySidecarTemplate(h.container(), namespace)
+	if err != nil {
+		return nil, err
+	}
+	containers := []v1.Container{container}
+	if adapter := h.adapterContainer(); adapter != nil {
+		containers = append(containers, *adapter)
+	}
+	return containers, nil
+}
+
+// adapterContainer returns the credential adapter injected after the credential helper in the container mode, which
+// serves the credentials of the credential helper to the containers in the format of the container credentials
+// provider.  It is nil in the other modes.
+func (h *helperConfig) adapterContainer() *v1.Container {
+	if h.mode != ContainerMode {
+		return nil
+	}
+	tokenFile := tokenMountPath + "/token"
+	port := strconv.Itoa(h.adapterPort)
+	container := v1.Container{
+		Name:            h.adapterContainerName(),
+		Image:           CredentialAdapterImage,
+		Command:         []string{adapterBinary, CredentialAdapterCommand},
+		Args:            []string{"--port", port, "--metadata-endpoint", h.endpoint(), "--authorization-token-file", tokenFile},
+		Resources:       h.resources,
+		SecurityContext: helperSecurityContext(),
+		VolumeMounts:    []v1.VolumeMount{tokenVolumeMount()},
+	}
+	h.configureSidecar(&container, h.adapterPort)
+	// like that of the credential helper, the probe only holds back the containers of the pod with native sidecars
+	if !h.sidecar() {
+		container.StartupProbe = &v1.Probe{
+			ProbeHandler: v1.ProbeHandler{
+				Exec: &v1.ExecAction{
+					Command: []string{adapterBinary, CredentialAdapterCommand, "--probe", "--port", port, "--authorization-token-file", tokenFile},
+				},
+			},
+			PeriodSeconds:    startupProbePeriodSeconds,
+			TimeoutSeconds:   startupProbeTimeoutSeconds,
+			FailureThreshold: startupProbeFailureThreshold,
+		}
+	}
+	return &container
+}
+
+// configureSidecar makes the container a native sidecar unless classic sidecars are used and, for pods using the host
+// network, declares the port it listens on as a host port so that the scheduler doesn't place pods using the same port
+// on a node
+func (h *helperConfig) configureSidecar(container *v1.Container, port int) {
+	if !h.sidecar() {
+		restartPolicyAlways := v1.ContainerRestartPolicyAlways
+		container.RestartPolicy = &restartPolicyAlways
+	}
+	if h.hostNetwork {
+		container.Ports = []v1.ContainerPort{
+			{
+				ContainerPort: int32(port),
+				HostPort:      int32(port),
+				Protocol:      v1.ProtocolTCP,
+			},
+		}
+	}
+}
+
+// installScript returns the script copying the credential helper out of its image and writing the AWS config file
+func installScript(configFile string) string {
+	return `cp "$(command -v aws_signing_helper)" ` + configMountPath + `/aws_signing_helper && printf '%s\n' "$IRA_AWS_CONFIG" > ` + configFile
+}
+
+// helperEnv returns the environment variables of the credential helper container
+func (h *helperConfig) helperEnv() []v1.EnvVar {
+	if referencesPodName(h.credentialOptions().RoleSessionName) {
+		return []v1.EnvVar{podNameEnvVar()}
+	}
+	return nil
+}
+
+// startupProbe returns the probe of the native credential helper sidecar that holds back the containers started after it
+// until credentials can be obtained.  The credential helper only listens on the loopback interface of the pod, which the
+// kubelet's HTTP probes can't reach, so rather than probing the endpoint it serves, the probe obtains credentials with
+// the credential helper itself using the same certificate and ARNs.  Classic sidecars start alongside the containers of
+// the pod, so they don't get the probe, which would only restart them.  The arguments of probes aren't expanded, so the
+// probe uses the default role session name when the role session name references the name of the pod.
+func (h *helperConfig) startupProbe() *v1.Probe {
+	options := h.credentialOptions()
+	if referencesPodName(options.RoleSessionName) {
+		options.RoleSessionName = ""
+	}
+	return &v1.Probe{
+		ProbeHandler: v1.ProbeHandler{
+			Exec: &v1.ExecAction{
+				Command: append([]string{"aws_signing_helper", "credential-process"}, options.args()...),
+			},
+		},
+		PeriodSeconds:    startupProbePeriodSeconds,
+		TimeoutSeconds:   startupProbeTimeoutSeconds,
+		FailureThreshold: startupProbeFailureThreshold,
+	}
+}
+
+// awsConfig returns the contents of the AWS config file using the installed credential helper as the credential_process
+func (h *helperConfig) awsConfig() string {
+	command := append([]string{configMountPath + "/aws_signing_helper", "credential-process"}, h.credentialOptions().args()...)
+	return fmt.Sprintf("[default]\ncredential_process = %s", strings.Join(command, " "))
+}
+
+// volumes returns the volumes of the credential helper, the certificate, named after the certificate of the pod, and
+// the volumes required by the credential mode
+func (h *helperConfig) volumes(certName string) []v1.Volume {
+	return append([]v1.Volume{
+		{
+			Name: h.certVolumeName(),
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName: util.RoleCertName(certName, h.name),
+				},
+			},
+		},
+	}, h.modeVolumes()...)
+}
+
+// modeVolumes returns the volumes, in addition to the certificate, required by the credential mode
+func (h *helperConfig) modeVolumes() []v1.Volume {
+	if h.mode == ProcessMode {
+		return []v1.Volume{
+			{
+				Name: configVolumeName,
+				VolumeSource: v1.VolumeSource{
+					EmptyDir: &v1.EmptyDirVolumeSource{},
+				},
+			},
+		}
+	}
+	if h.mode == ContainerMode {
+		return []v1.Volume{tokenVolume()}
+	}
+	return nil
+}
+
+// tokenVolume returns the projected service account token volume holding the token authorizing the requests for
+// credentials sent to the credential adapter
+func tokenVolume() v1.Volume {
+	expirationSeconds := int64(tokenExpirationSeconds)
+	return v1.Volume{
+		Name: tokenVolumeName,
+		VolumeSource: v1.VolumeSource{
+			Projected: &v1.ProjectedVolumeSource{
+				Sources: []v1.VolumeProjection{
+					{
+						ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+							Audience:          tokenAudience,
+							ExpirationSeconds: &expirationSeconds,
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// tokenVolumeMount returns the mount of the authorization token volume
+func tokenVolumeMount() v1.VolumeMount {
+	return v1.VolumeMount{
+		Name:      tokenVolumeName,
+		MountPath: tokenMountPath,
+		ReadOnly:  true,
+	}
+}
+
+// image returns the image of the credential helper
+func (h *helperConfig) image() string {
+	return annotationOrDefault(h.annotations, "ira.ontsys.com/image", CredentialHelperImage)
+}
+
+// endpoint returns the base URL the credential helper is listening on
+func (h *helperConfig) endpoint() string {
+	return fmt.Sprintf("http://127.0.0.1:%d", h.port)
+}
+
+// metadataEndpoint returns the endpoint of the credential helper to configure for the containers
+func (h *helperConfig) metadataEndpoint() string {
+	endpoint := h.endpoint()
+	if util.MapContains(h.annotations, "ira.ontsys.com/metadata-endpoint-trailing-slash") && h.annotations["ira.ontsys.com/metadata-endpoint-trailing-slash"] != "" {
+		endpoint += "/"
+	}
+	return endpoint
+}
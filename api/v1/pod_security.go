@@ -0,0 +1,175 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// podSecurityEnforceLabel is the label of a namespace selecting the Pod Security Standard its pods must comply with
+	podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+	// baselineLevel and restrictedLevel are the Pod Security Standards restricting the credential helper container
+	baselineLevel   = "baseline"
+	restrictedLevel = "restricted"
+	// helperUserID is the user and group the credential helper runs as, so that it runs as a non-root user whatever the
+	// user of its image (e.g. root or a user name the kubelet can't verify)
+	helperUserID = 65532
+)
+
+var (
+	// baselineCapabilities are the capabilities containers may add under the baseline Pod Security Standard
+	baselineCapabilities = sets.New[v1.Capability]("AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD", "NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT")
+	// baselineSELinuxTypes are the SELinux types containers may use under the baseline Pod Security Standard
+	baselineSELinuxTypes = sets.New("", "container_t", "container_init_t", "container_kvm_t", "container_engine_t")
+)
+
+// helperSecurityContext returns the security context of the credential helper container, which complies with the
+// restricted Pod Security Standard
+func helperSecurityContext() *v1.SecurityContext {
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := true
+	runAsNonRoot := true
+	runAsUser := int64(helperUserID)
+	return &v1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &v1.Capabilities{
+			Drop: []v1.Capability{"ALL"},
+		},
+		ReadOnlyRootFilesystem: &readOnlyRootFilesystem,
+		RunAsNonRoot:           &runAsNonRoot,
+		RunAsUser:              &runAsUser,
+		RunAsGroup:             &runAsUser,
+		SeccompProfile: &v1.SeccompProfile{
+			Type: v1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// podSecurityLevel returns the Pod Security Standard enforced in the namespace with the pod-security.kubernetes.io/enforce
+// label
+func podSecurityLevel(ctx context.Context, c client.Reader, namespace string) (string, error) {
+	ns := &v1.Namespace{}
+	if err := c.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return "", fmt.Errorf("unable to get the namespace %s: %w", namespace, err)
+	}
+	return ns.Labels[podSecurityEnforceLabel], nil
+}
+
+// checkPodSecurity returns an error if the credential helper container injected into the pod would violate the Pod
+// Security Standard enforced at the level in its namespace.  The container only violates it when the sidecar template
+// weakens its security context.
+func checkPodSecurity(level string, namespace string, pod *v1.Pod, container v1.Container) error {
+	if level != baselineLevel && level != restrictedLevel {
+		return nil
+	}
+
+	violations := baselineViolations(pod, container)
+	if level == restrictedLevel {
+		violations = append(violations, restrictedViolations(pod, container)...)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("the %s container would violate the %q Pod Security Standard enforced in namespace %s: %s", container.Name, level, namespace, strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// baselineViolations returns the checks of the baseline Pod Security Standard the container fails
+func baselineViolations(pod *v1.Pod, container v1.Container) []string {
+	var violations []string
+	sc := container.SecurityContext
+	if sc == nil {
+		sc = &v1.SecurityContext{}
+	}
+	if sc.Privileged != nil && *sc.Privileged {
+		violations = append(violations, "privileged must be unset or false")
+	}
+	if sc.Capabilities != nil {
+		for _, capability := range sc.Capabilities.Add {
+			if !baselineCapabilities.Has(capability) {
+				violations = append(violations, fmt.Sprintf("capability %s must not be added", capability))
+			}
+		}
+	}
+	if sc.ProcMount != nil && *sc.ProcMount != v1.DefaultProcMount {
+		violations = append(violations, "procMount must be unset or Default")
+	}
+	if sc.SELinuxOptions != nil && (!baselineSELinuxTypes.Has(sc.SELinuxOptions.Type) || sc.SELinuxOptions.User != "" || sc.SELinuxOptions.Role != "") {
+		violations = append(violations, "seLinuxOptions must not set a custom user, role or type")
+	}
+	if seccompProfileType(pod, sc) == v1.SeccompProfileTypeUnconfined {
+		violations = append(violations, "seccompProfile.type must not be Unconfined")
+	}
+	if sc.AppArmorProfile != nil && sc.AppArmorProfile.Type == v1.AppArmorProfileTypeUnconfined {
+		violations = append(violations, "appArmorProfile.type must not be Unconfined")
+	}
+	if slices.ContainsFunc(container.Ports, func(p v1.ContainerPort) bool { return p.HostPort != 0 }) {
+		violations = append(violations, "hostPort must not be used")
+	}
+	return violations
+}
+
+// restrictedViolations returns the checks of the restricted Pod Security Standard, in addition to those of the baseline
+// standard, the container fails
+func restrictedViolations(pod *v1.Pod, container v1.Container) []string {
+	var violations []string
+	sc := container.SecurityContext
+	if sc == nil {
+		sc = &v1.SecurityContext{}
+	}
+	if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		violations = append(violations, "allowPrivilegeEscalation must be false")
+	}
+	if sc.Capabilities == nil || !slices.Contains(sc.Capabilities.Drop, "ALL") {
+		violations = append(violations, "capabilities must drop ALL")
+	}
+	if sc.Capabilities != nil && slices.ContainsFunc(sc.Capabilities.Add, func(c v1.Capability) bool { return c != "NET_BIND_SERVICE" }) {
+		violations = append(violations, "capabilities must only add NET_BIND_SERVICE")
+	}
+	runAsNonRoot := sc.RunAsNonRoot
+	if runAsNonRoot == nil && pod.Spec.SecurityContext != nil {
+		runAsNonRoot = pod.Spec.SecurityContext.RunAsNonRoot
+	}
+	if runAsNonRoot == nil || !*runAsNonRoot {
+		violations = append(violations, "runAsNonRoot must be true")
+	}
+	if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		violations = append(violations, "runAsUser must not be 0")
+	}
+	if profile := seccompProfileType(pod, sc); profile != v1.SeccompProfileTypeRuntimeDefault && profile != v1.SeccompProfileTypeLocalhost {
+		violations = append(violations, "seccompProfile.type must be RuntimeDefault or Localhost")
+	}
+	return violations
+}
+
+// seccompProfileType returns the type of the seccomp profile of the container, which defaults to the one of the pod
+func seccompProfileType(pod *v1.Pod, sc *v1.SecurityContext) v1.SeccompProfileType {
+	if sc.SeccompProfile != nil {
+		return sc.SeccompProfile.Type
+	}
+	if pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.SeccompProfile != nil {
+		return pod.Spec.SecurityContext.SeccompProfile.Type
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/ontariosystems/ira-controller/internal/util"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ webhook.AdmissionHandler = &podIraValidator{}
+
+// +kubebuilder:webhook:path=/validate-core-v1-pod,mutating=false,failurePolicy=fail,sideEffects=None,groups=core,resources=pods,verbs=create;update,versions=v1,name=vpod.kb.io,admissionReviewVersions=v1
+
+// podIraValidator struct used to validate the IRA annotations of Kubernetes pods
+type podIraValidator struct {
+	Client  client.Client
+	decoder admission.Decoder
+}
+
+// NewPodIraValidator initializes and returns a new pod validator to handle webhook calls
+func NewPodIraValidator(client client.Client, scheme *runtime.Scheme) admission.Handler {
+	return &podIraValidator{
+		Client:  client,
+		decoder: admission.NewDecoder(scheme),
+	}
+}
+
+// Handle rejects pods with incomplete or invalid IRA annotations
+func (p *podIraValidator) Handle(ctx context.Context, request admission.Request) admission.Response {
+	pod := &v1.Pod{}
+	if err := p.decoder.Decode(request, pod); err != nil {
+		podlog.Error(err, "error occurred while decoding the admission request")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if !pod.DeletionTimestamp.IsZero() {
+		return admission.Allowed("pod terminating")
+	}
+
+	// Only validate updates that change the IRA annotations so that existing pods can still be updated (e.g. to remove
+	// finalizers) after the validation rules change
+	if request.Operation == admissionv1.Update {
+		oldPod := &v1.Pod{}
+		if err := p.decoder.DecodeRaw(request.OldObject, oldPod); err != nil {
+			podlog.Error(err, "error occurred while decoding the existing pod")
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if equalIraAnnotations(oldPod.Annotations, pod.Annotations) {
+			return admission.Allowed("IRA annotations unchanged")
+		}
+	}
+
+	workload, err := podWorkloadAnnotations(ctx, p.Client, request.Namespace, pod)
+	if err != nil {
+		podlog.Error(err, "error occurred while getting the workload of the pod")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	path := field.NewPath("metadata", "annotations")
+	annotations, errs := resolveAnnotations(ctx, p.Client, request.Namespace, util.ServiceAccountName(&pod.Spec), workload, pod.Annotations, path)
+	if len(errs) == 0 {
+		errs = validateAnnotations(annotations, path)
+	}
+	if len(errs) > 0 {
+		podlog.Info("Denying pod with invalid IRA annotations", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", errs.ToAggregate().Error())
+		return invalidResponse(schema.GroupKind{Kind: "Pod"}, pod.Name, errs)
+	}
+	return admission.Allowed("")
+}
+
+// invalidResponse denies the request with a status listing each invalid field so that clients can report them.  Errors
+// looking up the configuration (e.g. a failed GET of the namespace) fail the request instead, as they may be transient.
+func invalidResponse(kind schema.GroupKind, name string, errs field.ErrorList) admission.Response {
+	for _, err := range errs {
+		if err.Type == field.ErrorTypeInternal {
+			return admission.Errored(http.StatusInternalServerError, errs.ToAggregate())
+		}
+	}
+	status := apierrors.NewInvalid(kind, name, errs).Status()
+	return admission.Response{
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &status,
+		},
+	}
+}
+
+// equalIraAnnotations reports whether both sets of annotations have the same ira.ontsys.com annotations
+func equalIraAnnotations(a map[string]string, b map[string]string) bool {
+	count := 0
+	for key, value := range a {
+		if !strings.HasPrefix(key, util.AnnotationPrefix) {
+			continue
+		}
+		count++
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	for key := range b {
+		if strings.HasPrefix(key, util.AnnotationPrefix) {
+			count--
+		}
+	}
+	return count == 0
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var _ = Describe("Pod Validator", func() {
+	BeforeEach(func() {
+		CredentialHelperImage = "test-image:latest"
+		CredentialHelperCpuRequest = "250m"
+		CredentialHelperMemoryRequest = "64Mi"
+		CredentialHelperMemoryLimit = "128Mi"
+		SessionDuration = "900"
+		CredentialHelperPort = 9911
+	})
+
+	Context("When creating Pod under Validating Webhook", func() {
+		It("should allow a pod with valid IRA annotations", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "valid-annotations", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/issuer-kind":  "Issuer",
+			}))).To(Succeed())
+		})
+		It("should deny a pod with partial IRA annotations", func() {
+			ctx := context.Background()
+			err := k8sClient.Create(ctx, newTestPod("default", "partial-annotations", map[string]string{
+				"ira.ontsys.com/role": roleArn,
+			}))
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err).To(MatchError(And(
+				ContainSubstring("metadata.annotations[ira.ontsys.com/trust-anchor]: Required value"),
+				ContainSubstring("metadata.annotations[ira.ontsys.com/profile]: Required value"),
+			)))
+			Expect(err.(apierrors.APIStatus).Status().Details.Causes).To(ContainElement(And(
+				HaveField("Type", Equal(metav1.CauseTypeFieldValueRequired)),
+				HaveField("Field", Equal("metadata.annotations[ira.ontsys.com/profile]")),
+			)))
+		})
+		It("should deny a pod with an unknown IRA annotation", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "unknown-annotation", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/issuer":       "i",
+			}))).To(MatchError(ContainSubstring("metadata.annotations[ira.ontsys.com/issuer]: Forbidden: unknown IRA annotation")))
+		})
+		It("should deny a pod with an invalid issuer kind", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "invalid-issuer-kind", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/issuer-kind":  "Secret",
+			}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/issuer-kind]: Unsupported value: "Secret": supported values: "ClusterIssuer", "Issuer"`)))
+		})
+		It("should deny a pod with an unparseable duration", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "invalid-duration", map[string]string{
+				"ira.ontsys.com/trust-anchor":     trustAnchorArn,
+				"ira.ontsys.com/profile":          profileArn,
+				"ira.ontsys.com/role":             roleArn,
+				"ira.ontsys.com/session-duration": "15m",
+			}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/session-duration]: Invalid value: "15m": must be a number of seconds`)))
+		})
+		It("should deny a pod with an unparseable resource quantity", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "invalid-quantity", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/cpu-request":  "lots",
+			}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/cpu-request]: Invalid value: "lots": must be a non-negative quantity`)))
+		})
+		It("should deny a pod with a session duration outside of the IAM bounds", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "invalid-session-duration", map[string]string{
+				"ira.ontsys.com/trust-anchor":     trustAnchorArn,
+				"ira.ontsys.com/profile":          profileArn,
+				"ira.ontsys.com/role":             roleArn,
+				"ira.ontsys.com/session-duration": "60",
+			}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/session-duration]: Invalid value: "60": must be between 900 and 43200 seconds`)))
+		})
+		It("should deny a pod with invalid credential helper options", func() {
+			ctx := context.Background()
+			err := k8sClient.Create(ctx, newTestPod("default", "invalid-helper-options", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/region":       "east",
+				"ira.ontsys.com/endpoint":     "rolesanywhere.example.com",
+				"ira.ontsys.com/debug":        "yes",
+			}))
+			Expect(err).To(MatchError(And(
+				ContainSubstring(`metadata.annotations[ira.ontsys.com/region]: Invalid value: "east"`),
+				ContainSubstring(`metadata.annotations[ira.ontsys.com/endpoint]: Invalid value: "rolesanywhere.example.com"`),
+				ContainSubstring(`metadata.annotations[ira.ontsys.com/debug]: Unsupported value: "yes": supported values: "false", "true"`),
+			)))
+		})
+		It("should deny a pod with invalid additional roles", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "invalid-roles", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/roles":        `{"backup": {"role": "arn:aws:iam::123456789012:user/backup", "containers": ["my-container"]}}`,
+			}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/roles][backup][ira.ontsys.com/role]`)))
+			Expect(k8sClient.Create(ctx, newTestPod("default", "unparseable-roles", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/roles":        `{"Backup": {"role": "arn:aws:iam::123456789012:role/backup", "containers": ["my-container"]}}`,
+			}))).To(MatchError(ContainSubstring(`role name "Backup" in ira.ontsys.com/roles is invalid`)))
+		})
+		It("should deny a pod with an invalid opt-out", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "invalid-inject", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/inject":       "no",
+			}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/inject]: Unsupported value: "no": supported values: "false", "true"`)))
+		})
+		It("should deny a pod providing an annotation reserved for IRAClasses", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newTestPod("default", "class-annotation", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/image":        "my-image",
+			}))).To(MatchError(ContainSubstring("metadata.annotations[ira.ontsys.com/image]: Forbidden: may only be provided by an IRAClass")))
+		})
+		It("should deny an update that makes the IRA annotations invalid", func() {
+			ctx := context.Background()
+			pod := newTestPod("default", "invalid-update", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+			})
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "invalid-update"}, pod)).To(Succeed())
+			pod.Annotations["ira.ontsys.com/session-duration"] = "soon"
+			Expect(k8sClient.Update(ctx, pod)).To(MatchError(ContainSubstring("metadata.annotations[ira.ontsys.com/session-duration]")))
+		})
+		It("should fail rather than deny a pod when its configuration can't be looked up", func() {
+			path := field.NewPath("metadata", "annotations")
+			response := invalidResponse(schema.GroupKind{Kind: "Pod"}, "lookup-failure", field.ErrorList{
+				field.Invalid(path.Key("ira.ontsys.com/session-duration"), "soon", "must be a number of seconds"),
+				field.InternalError(path, errors.New("unable to get the namespace default")),
+			})
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.Result.Code).To(Equal(int32(http.StatusInternalServerError)))
+		})
+	})
+})
@@ -18,16 +18,21 @@ package v1
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"slices"
-
-	"k8s.io/apimachinery/pkg/api/resource"
+	"strconv"
+	"strings"
 
 	"github.com/ontariosystems/ira-controller/internal/util"
+	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
@@ -46,7 +51,18 @@ var (
 	SessionDuration               string
 )
 
-// +kubebuilder:webhook:path=/mutate-core-v1-pod,mutating=true,failurePolicy=fail,sideEffects=None,groups=core,resources=pods,verbs=create;update,versions=v1,name=mpod.kb.io,admissionReviewVersions=v1
+const (
+	// certVolumeName is the name of the volume holding the certificate used by the credential helper
+	certVolumeName = "ira-cert"
+	// certMountPath is the directory the certificate is mounted in
+	certMountPath = "/ira-cert"
+	// helperContainerName is the name of the injected credential helper container
+	helperContainerName = "ira"
+	// injectedAnnotation marks a pod that has already been mutated by the webhook
+	injectedAnnotation = "ira.ontsys.com/injected"
+)
+
+// +kubebuilder:webhook:path=/mutate-core-v1-pod,mutating=true,failurePolicy=fail,sideEffects=None,groups=core,resources=pods;pods/ephemeralcontainers,verbs=create;update,versions=v1,name=mpod.kb.io,admissionReviewVersions=v1
 
 // podIraInjector struct used to handle admission control for Kubernetes pods
 type podIraInjector struct {
@@ -75,6 +91,14 @@ func (p *podIraInjector) Handle(ctx context.Context, request admission.Request)
 
 	podlog.Info("handling the pod CREATE/UPDATE event for", "pod name", pod.Name, "pod namespace", pod.Namespace, "pod generate name", pod.GenerateName)
 
+	if request.Operation == admissionv1.Update && request.SubResource == "" {
+		return p.handleUpdate(request, pod)
+	}
+	if request.Operation == admissionv1.Create {
+		// only the webhook marks the pods it mutates, so a marker provided by the pod itself is dropped
+		delete(pod.Annotations, injectedAnnotation)
+	}
+
 	if !pod.DeletionTimestamp.IsZero() {
 		podlog.Info("Skipping terminating pod")
 		return admission.Allowed("pod terminating")
@@ -85,83 +109,224 @@ func (p *podIraInjector) Handle(ctx context.Context, request admission.Request)
 		return admission.Allowed("pod finished")
 	}
 
-	if util.MapContains(pod.Annotations, "ira.ontsys.com/trust-anchor") && util.MapContains(pod.Annotations, "ira.ontsys.com/profile") && util.MapContains(pod.Annotations, "ira.ontsys.com/role") {
-		if pod.Spec.Volumes == nil {
-			pod.Spec.Volumes = make([]v1.Volume, 0)
+	workload, err := podWorkloadAnnotations(ctx, p.Client, request.Namespace, pod)
+	if err != nil {
+		podlog.Error(err, "error occurred while getting the workload of the pod")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	// the class-only annotations of the pod are rejected here too, so that a pod can't choose the image of its
+	// credential helper when the validating webhook isn't installed or fails open
+	path := field.NewPath("metadata", "annotations")
+	annotations, errs := resolveAnnotations(ctx, p.Client, request.Namespace, util.ServiceAccountName(&pod.Spec), workload, pod.Annotations, path)
+	if len(errs) > 0 {
+		podlog.Info("Denying pod with unresolvable IRA configuration", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", errs.ToAggregate().Error())
+		return invalidResponse(schema.GroupKind{Kind: "Pod"}, pod.Name, errs)
+	}
+
+	if request.SubResource == "ephemeralcontainers" {
+		return p.handleEphemeralContainers(request, pod, annotations)
+	}
+
+	if util.MapContains(annotations, "ira.ontsys.com/trust-anchor") && util.MapContains(annotations, "ira.ontsys.com/profile") && util.MapContains(annotations, "ira.ontsys.com/role") {
+		if errs := validateAnnotations(annotations, path); len(errs) > 0 {
+			podlog.Info("Denying pod with invalid IRA annotations", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", errs.ToAggregate().Error())
+			return invalidResponse(schema.GroupKind{Kind: "Pod"}, pod.Name, errs)
 		}
-		secretName, _ := util.ControllerNameFromPod(pod)
-		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
-			Name: "ira-cert",
-			VolumeSource: v1.VolumeSource{
-				Secret: &v1.SecretVolumeSource{
-					SecretName: util.GetCertName(pod.Annotations, secretName),
-				},
-			},
-		})
 
-		endpoint := "http://127.0.0.1:9911"
-		if util.MapContains(pod.Annotations, "ira.ontsys.com/metadata-endpoint-trailing-slash") && pod.Annotations["ira.ontsys.com/metadata-endpoint-trailing-slash"] != "" {
-			endpoint += "/"
+		// the additional roles were validated with the annotations
+		roles, _ := util.AdditionalRoles(annotations)
+		roleAnnotations := []map[string]string{annotations}
+		for _, role := range roles {
+			roleAnnotations = append(roleAnnotations, role.Annotations(annotations))
+		}
+		for _, a := range roleAnnotations {
+			if err := util.AuthorizeRole(ctx, p.Client, request.Namespace, pod, a); errors.Is(err, util.ErrUnauthorized) {
+				podlog.Info("Denying pod with unauthorized role", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", err.Error())
+				return admission.Denied(err.Error())
+			} else if err != nil {
+				podlog.Error(err, "error occurred while authorizing the role")
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
 		}
 
-		for i, c := range pod.Spec.Containers {
-			if c.Env == nil {
-				c.Env = make([]v1.EnvVar, 0)
+		selected, err := containerSelector(pod, annotations)
+		if err != nil {
+			podlog.Info("Denying pod with invalid container selection", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", err.Error())
+			return admission.Denied(err.Error())
+		}
+		roleSelected := make(map[string]func(name string) bool)
+		for _, role := range roles {
+			if roleSelected[role.Name], err = roleContainerSelector(pod, role); err != nil {
+				podlog.Info("Denying pod with invalid container selection", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", err.Error())
+				return admission.Denied(err.Error())
 			}
-			c.Env = append(c.Env, v1.EnvVar{
-				Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
-				Value: endpoint,
-			})
-			pod.Spec.Containers[i] = c
-		}
-
-		restartPolicyAlways := v1.ContainerRestartPolicyAlways
-		resources := v1.ResourceRequirements{
-			Limits:   v1.ResourceList{},
-			Requests: v1.ResourceList{},
-		}
-		if CredentialHelperCpuRequest != "" {
-			resources.Requests[v1.ResourceCPU] = resource.MustParse(CredentialHelperCpuRequest)
-		}
-		if CredentialHelperCpuLimit != "" {
-			resources.Limits[v1.ResourceCPU] = resource.MustParse(CredentialHelperCpuLimit)
-		}
-		if CredentialHelperMemoryRequest != "" {
-			resources.Requests[v1.ResourceMemory] = resource.MustParse(CredentialHelperMemoryRequest)
-		}
-		if CredentialHelperMemoryLimit != "" {
-			resources.Limits[v1.ResourceMemory] = resource.MustParse(CredentialHelperMemoryLimit)
-		}
-
-		pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{
-			Name:    "ira",
-			Image:   CredentialHelperImage,
-			Command: []string{"aws_signing_helper"},
-			Args: []string{
-				"serve",
-				"--certificate",
-				"/ira-cert/tls.crt",
-				"--private-key",
-				"/ira-cert/tls.key",
-				"--trust-anchor-arn",
-				pod.Annotations["ira.ontsys.com/trust-anchor"],
-				"--profile-arn",
-				pod.Annotations["ira.ontsys.com/profile"],
-				"--role-arn",
-				pod.Annotations["ira.ontsys.com/role"],
-				fmt.Sprintf("'--session-duration=%s'", SessionDuration),
-			},
-			RestartPolicy: &restartPolicyAlways,
-			Resources:     resources,
-			VolumeMounts: []v1.VolumeMount{
-				{
-					Name:      "ira-cert",
-					MountPath: "/ira-cert",
-				},
-			},
-		})
+		}
+
+		helpers, err := newHelperConfigs(pod, annotations, string(request.UID))
+		if err != nil {
+			podlog.Info("Denying pod with invalid credential helper configuration", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", err.Error())
+			return admission.Denied(err.Error())
+		}
+
+		sessionName, err := roleSessionName(ctx, p.Client, request.Namespace, pod)
+		if err != nil {
+			podlog.Error(err, "error occurred while rendering the role session name")
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+
+		level, err := podSecurityLevel(ctx, p.Client, request.Namespace)
+		if err != nil {
+			podlog.Error(err, "error occurred while getting the Pod Security Standard of the namespace")
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+
+		containers := make([][]v1.Container, len(helpers))
+		for i, helper := range helpers {
+			helper.roleSessionName = sessionName
+			if containers[i], err = helper.injectedContainers(request.Namespace); err != nil {
+				podlog.Error(err, "error occurred while applying the sidecar template")
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			for _, container := range containers[i] {
+				if err := checkPodSecurity(level, request.Namespace, pod, container); err != nil {
+					podlog.Info("Denying pod violating the Pod Security Standard of its namespace", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", err.Error())
+					return admission.Denied(err.Error())
+				}
+			}
+		}
+
+		secretName, _ := util.ControllerNameFromPod(pod)
+		certName := util.GetCertName(annotations, secretName)
+		var volumes []v1.Volume
+		for _, helper := range helpers {
+			volumes = append(volumes, helper.volumes(certName)...)
+		}
+		if err := checkReservedNames(pod, slices.Concat(containers...), volumes); err != nil {
+			podlog.Info("Denying pod with conflicting names", "pod name", pod.Name, "pod namespace", pod.Namespace, "reason", err.Error())
+			return admission.Denied(err.Error())
+		}
+
+		for index, helper := range helpers {
+			for _, volume := range helper.volumes(certName) {
+				pod.Spec.Volumes = upsertVolume(pod.Spec.Volumes, volume)
+			}
+
+			// a pod admitted again may have the credential helper in the other list when the sidecar mode changed
+			isHelper := func(c v1.Container) bool {
+				return slices.ContainsFunc(containers[index], func(h v1.Container) bool { return c.Name == h.Name })
+			}
+			if helper.sidecar() {
+				pod.Spec.InitContainers = slices.DeleteFunc(pod.Spec.InitContainers, isHelper)
+				pod.Spec.Containers = upsertContainers(pod.Spec.Containers, containers[index], false)
+			} else {
+				pod.Spec.Containers = slices.DeleteFunc(pod.Spec.Containers, isHelper)
+				// only the credential helper of the primary role is started first, the native sidecars of additional
+				// roles are appended to the init containers so that only the regular containers use them
+				pod.Spec.InitContainers = upsertContainers(pod.Spec.InitContainers, containers[index], helper.first && helper.name == "")
+			}
+
+			isSelected := selected
+			if helper.name != "" {
+				isSelected = roleSelected[helper.name]
+			}
+			config := helper.containerConfig()
+			for i := range pod.Spec.Containers {
+				if isSelected(pod.Spec.Containers[i].Name) {
+					config.applyTo(&pod.Spec.Containers[i])
+				}
+			}
+			if helper.first && helper.name == "" {
+				// only the init containers started after the helper are able to reach it
+				helperIndex := slices.IndexFunc(pod.Spec.InitContainers, func(c v1.Container) bool { return c.Name == helperContainerName })
+				for i := helperIndex + 1; i < len(pod.Spec.InitContainers); i++ {
+					if isSelected(pod.Spec.InitContainers[i].Name) {
+						config.applyTo(&pod.Spec.InitContainers[i])
+					}
+				}
+			}
+		}
+
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[injectedAnnotation] = "true"
+		if helpers[0].mode != ProcessMode {
+			// record the port so that it is reused when the pod is admitted again
+			pod.Annotations["ira.ontsys.com/port"] = strconv.Itoa(helpers[0].port)
+		}
+	}
+
+	return patchResponse(request, pod)
+}
+
+// handleUpdate allows updates of a pod without changing its spec, which is immutable apart from a few fields, so that
+// updates of its metadata keep working after the configuration of the credential helper changes.  The injected marker
+// is kept as the webhook set it when the pod was created.
+func (p *podIraInjector) handleUpdate(request admission.Request, pod *v1.Pod) admission.Response {
+	oldPod := &v1.Pod{}
+	if err := p.decoder.DecodeRaw(request.OldObject, oldPod); err != nil {
+		podlog.Error(err, "error occurred while decoding the existing pod")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	marker, injected := oldPod.Annotations[injectedAnnotation]
+	if current, ok := pod.Annotations[injectedAnnotation]; ok == injected && current == marker {
+		return admission.Allowed("pod spec is immutable")
+	}
+	if injected {
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[injectedAnnotation] = marker
+	} else {
+		delete(pod.Annotations, injectedAnnotation)
+	}
+	return patchResponse(request, pod)
+}
+
+// handleEphemeralContainers configures the ephemeral containers being added to an injected pod (e.g. by kubectl debug)
+// to use the credential helper.  Existing ephemeral containers can't be modified so only the new ones are changed.
+func (p *podIraInjector) handleEphemeralContainers(request admission.Request, pod *v1.Pod, annotations map[string]string) admission.Response {
+	oldPod := &v1.Pod{}
+	if err := p.decoder.DecodeRaw(request.OldObject, oldPod); err != nil {
+		podlog.Error(err, "error occurred while decoding the existing pod")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// the marker of the stored pod is the one set by the webhook, the request can't change it
+	if !util.MapContains(oldPod.Annotations, injectedAnnotation) {
+		podlog.Info("Skipping ephemeral containers for pod without credential helper")
+		return admission.Allowed("pod not injected")
+	}
+	existing := sets.New[string]()
+	for _, c := range oldPod.Spec.EphemeralContainers {
+		existing.Insert(c.Name)
 	}
 
+	helper, err := newHelperConfig(pod, annotations, string(request.UID))
+	if err != nil {
+		return admission.Denied(err.Error())
+	}
+	config := helper.containerConfig()
+	// ephemeral containers are only wired to the credential helper of the primary role, so those targeting a container
+	// of an additional role would get the wrong role
+	roleContainers := sets.New(util.AdditionalRoleContainers(annotations)...)
+	for i := range pod.Spec.EphemeralContainers {
+		c := &pod.Spec.EphemeralContainers[i]
+		if existing.Has(c.Name) {
+			continue
+		}
+		if roleContainers.Has(c.TargetContainerName) {
+			podlog.Info("Denying ephemeral container targeting a container of an additional role", "pod name", pod.Name, "pod namespace", pod.Namespace, "container", c.Name)
+			return admission.Denied(fmt.Sprintf("ephemeral container %q targets container %q of an additional role, ephemeral containers can only use the primary role", c.Name, c.TargetContainerName))
+		}
+		config.applyTo((*v1.Container)(&c.EphemeralContainerCommon))
+	}
+
+	return patchResponse(request, pod)
+}
+
+// patchResponse returns a response patching the pod in the request to the provided pod
+func patchResponse(request admission.Request, pod *v1.Pod) admission.Response {
 	marshaledpod, err := json.Marshal(pod)
 
 	if err != nil {
@@ -173,6 +338,160 @@ func (p *podIraInjector) Handle(ctx context.Context, request admission.Request)
 	return admission.PatchResponseFromRaw(request.AdmissionRequest.Object.Raw, marshaledpod)
 }
 
+// checkReservedNames returns an error if the pod defines its own containers or volumes using the names reserved for
+// the injected credential helper.  The containers and volumes the webhook generated when the pod was admitted before
+// (e.g. when a mutated pod is recreated) are recognised by the image and command of the generated containers and the
+// source of the generated volumes, so that they are replaced rather than denied.
+func checkReservedNames(pod *v1.Pod, containers []v1.Container, volumes []v1.Volume) error {
+	reserved := sets.New(certVolumeName, configVolumeName, tokenVolumeName)
+	roles, _ := util.AdditionalRoles(pod.Annotations)
+	for _, role := range roles {
+		reserved.Insert((&helperConfig{name: role.Name}).certVolumeName())
+	}
+	for _, vol := range pod.Spec.Volumes {
+		generated := slices.ContainsFunc(volumes, func(v v1.Volume) bool { return isGeneratedVolume(vol, v) })
+		if reserved.Has(vol.Name) && !generated {
+			return fmt.Errorf("volume name %q is reserved for the IRA credential helper", vol.Name)
+		}
+	}
+	helpers := helperContainerNames(pod.Annotations)
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		generated := slices.ContainsFunc(containers, func(h v1.Container) bool {
+			return c.Name == h.Name && c.Image == h.Image && slices.Equal(c.Command, h.Command)
+		})
+		if helpers.Has(c.Name) && !generated {
+			return fmt.Errorf("container name %q is reserved for the IRA credential helper", c.Name)
+		}
+	}
+	return nil
+}
+
+// isGeneratedVolume reports whether the volume is the generated volume, ignoring the fields defaulted by the API server.
+// A generated certificate volume without a secret name matches any secret, as the name of the certificate of the pods
+// of a pod template is only known once they are created.
+func isGeneratedVolume(volume v1.Volume, generated v1.Volume) bool {
+	if volume.Name != generated.Name {
+		return false
+	}
+	switch {
+	case generated.Secret != nil:
+		return volume.Secret != nil && (generated.Secret.SecretName == "" || volume.Secret.SecretName == generated.Secret.SecretName)
+	case generated.EmptyDir != nil:
+		return volume.EmptyDir != nil
+	case generated.Projected != nil:
+		return volume.Projected != nil && slices.EqualFunc(volume.Projected.Sources, generated.Projected.Sources, func(a v1.VolumeProjection, b v1.VolumeProjection) bool {
+			return a.ServiceAccountToken != nil && b.ServiceAccountToken != nil && a.ServiceAccountToken.Audience == b.ServiceAccountToken.Audience && a.ServiceAccountToken.Path == b.ServiceAccountToken.Path
+		})
+	}
+	return false
+}
+
+// containerSelector returns a function reporting whether a container should be wired to the credential helper of the
+// primary role based on the ira.ontsys.com/containers and ira.ontsys.com/exclude-containers annotations.  When neither
+// annotation is present every container that isn't mapped to an additional role is selected.
+func containerSelector(pod *v1.Pod, annotations map[string]string) (func(name string) bool, error) {
+	names := sets.New[string]()
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		names.Insert(c.Name)
+	}
+	include, err := containerList(annotations, "ira.ontsys.com/containers", names)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := containerList(annotations, "ira.ontsys.com/exclude-containers", names)
+	if err != nil {
+		return nil, err
+	}
+	helpers := helperContainerNames(annotations)
+	exclude.Insert(util.AdditionalRoleContainers(annotations)...)
+	return func(name string) bool {
+		return !helpers.Has(name) && (include.Len() == 0 || include.Has(name)) && !exclude.Has(name)
+	}, nil
+}
+
+// roleContainerSelector returns a function reporting whether a container should be wired to the credential helper of
+// the additional role, verifying that each of the containers mapped to it is a regular container of the pod
+func roleContainerSelector(pod *v1.Pod, role util.AdditionalRole) (func(name string) bool, error) {
+	names := sets.New[string]()
+	for _, c := range pod.Spec.Containers {
+		names.Insert(c.Name)
+	}
+	for _, name := range role.Containers {
+		if !names.Has(name) {
+			return nil, fmt.Errorf("container %q of role %q in %s is not a container of the pod", name, role.Name, util.RolesAnnotation)
+		}
+	}
+	containers := sets.New(role.Containers...)
+	return containers.Has, nil
+}
+
+// containerList parses the comma separated list of container names in the annotation and verifies that each of them
+// exists in the pod
+func containerList(annotations map[string]string, annotation string, names sets.Set[string]) (sets.Set[string], error) {
+	list := sets.New[string]()
+	for _, name := range strings.Split(annotations[annotation], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !names.Has(name) {
+			return nil, fmt.Errorf("container %q listed in %s does not exist in the pod", name, annotation)
+		}
+		list.Insert(name)
+	}
+	return list, nil
+}
+
+// upsertVolume replaces the volume with the same name or appends it if it doesn't exist
+func upsertVolume(volumes []v1.Volume, volume v1.Volume) []v1.Volume {
+	for i, vol := range volumes {
+		if vol.Name == volume.Name {
+			volumes[i] = volume
+			return volumes
+		}
+	}
+	return append(volumes, volume)
+}
+
+// upsertContainers replaces the containers with the same names and adds the others, in order, either before the other
+// containers or after them
+func upsertContainers(containers []v1.Container, upserted []v1.Container, first bool) []v1.Container {
+	var added []v1.Container
+	for _, container := range upserted {
+		if i := slices.IndexFunc(containers, func(c v1.Container) bool { return c.Name == container.Name }); i >= 0 {
+			containers[i] = container
+		} else {
+			added = append(added, container)
+		}
+	}
+	if first {
+		return slices.Insert(containers, 0, added...)
+	}
+	return append(containers, added...)
+}
+
+// upsertVolumeMount replaces the volume mount with the same name or appends it if it doesn't exist
+func upsertVolumeMount(mounts []v1.VolumeMount, mount v1.VolumeMount) []v1.VolumeMount {
+	for i, m := range mounts {
+		if m.Name == mount.Name {
+			mounts[i] = mount
+			return mounts
+		}
+	}
+	return append(mounts, mount)
+}
+
+// upsertEnv replaces the value of an environment variable with the same name or appends it if it doesn't exist
+func upsertEnv(env []v1.EnvVar, envVar v1.EnvVar) []v1.EnvVar {
+	for i, e := range env {
+		if e.Name == envVar.Name {
+			env[i] = envVar
+			return env
+		}
+	}
+	return append(env, envVar)
+}
+
 // InjectDecoder injects the decoder.
 func (p *podIraInjector) InjectDecoder(d admission.Decoder) error {
 	p.decoder = d
@@ -18,18 +18,35 @@ package v1
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
+	"github.com/ontariosystems/ira-controller/internal/util"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	trustAnchorArn = "arn:aws:rolesanywhere:us-east-1:123456789012:trust-anchor/ta"
+	profileArn     = "arn:aws:rolesanywhere:us-east-1:123456789012:profile/p"
+	roleArn        = "arn:aws:iam::123456789012:role/c"
+)
+
 var _ = Describe("Pod Webhook", func() {
 	var buffer *gbytes.Buffer
 	BeforeEach(func() {
@@ -40,10 +57,13 @@ var _ = Describe("Pod Webhook", func() {
 		CredentialHelperMemoryRequest = "64Mi"
 		CredentialHelperMemoryLimit = "128Mi"
 		SessionDuration = "900"
+		CredentialHelperPort = 9911
 	})
 	AfterEach(func() {
 		GinkgoWriter.ClearTeeWriters()
 		CredentialHelperCpuLimit = ""
+		HostNetworkPortRange = ""
+		SidecarMode = ""
 	})
 
 	Context("When creating Pod under Mutating Webhook", func() {
@@ -78,9 +98,9 @@ var _ = Describe("Pod Webhook", func() {
 				pod := &v1.Pod{
 					ObjectMeta: metav1.ObjectMeta{
 						Annotations: map[string]string{
-							"ira.ontsys.com/trust-anchor": "ta",
-							"ira.ontsys.com/profile":      "p",
-							"ira.ontsys.com/role":         "c",
+							"ira.ontsys.com/trust-anchor": trustAnchorArn,
+							"ira.ontsys.com/profile":      profileArn,
+							"ira.ontsys.com/role":         roleArn,
 						},
 						Name:      "annotated",
 						Namespace: "default",
@@ -100,26 +120,30 @@ var _ = Describe("Pod Webhook", func() {
 					return buffer
 				}, 5*time.Second, 25*time.Millisecond).Should(gbytes.Say("Attempting to patch pod"))
 
-				mutatedPod := &v1.Pod{}
-				Eventually(func() bool {
-					err := k8sClient.Get(ctx, types.NamespacedName{
-						Namespace: "default",
-						Name:      "annotated",
-					}, mutatedPod)
-					return err == nil
-				}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+				mutatedPod := getPod(ctx, "default", "annotated")
 				Expect(mutatedPod.Spec.Volumes).To(ContainElement(HaveField("Name", Equal("ira-cert"))))
 				Expect(mutatedPod.Spec.Volumes).To(ContainElement(HaveField("VolumeSource.Secret.SecretName", "annotated-ira")))
-				Expect(mutatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", ContainElement(v1.EnvVar{
-					Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
-					Value: "http://127.0.0.1:9911",
-				}))))
+				Expect(mutatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", ContainElements(
+					v1.EnvVar{
+						Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+						Value: "http://127.0.0.1:9911",
+					},
+					v1.EnvVar{
+						Name:  "AWS_REGION",
+						Value: "us-east-1",
+					},
+				))))
 				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Name", Equal("ira"))))
 				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("VolumeMounts", ContainElement(v1.VolumeMount{
 					Name:      "ira-cert",
 					MountPath: "/ira-cert",
 				}))))
-				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Args", ContainElements("ta", "p", "c"))))
+				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Args", ContainElements(trustAnchorArn, profileArn, roleArn))))
+				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("StartupProbe.Exec.Command", HaveExactElements(
+					"aws_signing_helper", "credential-process",
+					"--certificate", "/ira-cert/tls.crt", "--private-key", "/ira-cert/tls.key",
+					"--trust-anchor-arn", trustAnchorArn, "--profile-arn", profileArn, "--role-arn", roleArn, "--session-duration", "900", "--region", "us-east-1",
+				))))
 				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Resources", v1.ResourceRequirements{
 					Limits: v1.ResourceList{
 						v1.ResourceMemory: resource.MustParse("128Mi"),
@@ -142,9 +166,9 @@ var _ = Describe("Pod Webhook", func() {
 					pod := &v1.Pod{
 						ObjectMeta: metav1.ObjectMeta{
 							Annotations: map[string]string{
-								"ira.ontsys.com/trust-anchor": "ta",
-								"ira.ontsys.com/profile":      "p",
-								"ira.ontsys.com/role":         "c",
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
 							},
 							Name:      "limited",
 							Namespace: "default",
@@ -164,14 +188,7 @@ var _ = Describe("Pod Webhook", func() {
 						return buffer
 					}, 5*time.Second, 25*time.Millisecond).Should(gbytes.Say("Attempting to patch pod"))
 
-					mutatedPod := &v1.Pod{}
-					Eventually(func() bool {
-						err := k8sClient.Get(ctx, types.NamespacedName{
-							Namespace: "default",
-							Name:      "limited",
-						}, mutatedPod)
-						return err == nil
-					}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+					mutatedPod := getPod(ctx, "default", "limited")
 					Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Resources", v1.ResourceRequirements{
 						Limits: v1.ResourceList{
 							v1.ResourceCPU:    resource.MustParse("500m"),
@@ -184,18 +201,159 @@ var _ = Describe("Pod Webhook", func() {
 					})))
 				})
 			})
-			Context("using a provided certificate name", func() {
-				It("should mutate the pod using the provided certificate name", func() {
+			Context("when the pod overrides the resources of the credential helper", func() {
+				BeforeEach(func() {
+					CredentialHelperMaxMemory = "512Mi"
+				})
+				AfterEach(func() {
+					CredentialHelperMaxMemory = ""
+				})
+				It("should use the resources of the pod", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newTestPod("default", "overridden-resources", withIraAnnotations(map[string]string{
+						"ira.ontsys.com/memory-request": "128Mi",
+						"ira.ontsys.com/memory-limit":   "256Mi",
+					})))).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "overridden-resources")
+					Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Resources", v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							v1.ResourceMemory: resource.MustParse("256Mi"),
+						},
+						Requests: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("250m"),
+							v1.ResourceMemory: resource.MustParse("128Mi"),
+						},
+					})))
+				})
+				It("should deny a resource above its maximum", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newTestPod("default", "excessive-resources", withIraAnnotations(map[string]string{
+						"ira.ontsys.com/memory-limit": "1Gi",
+					})))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/memory-limit]: Invalid value: "1Gi": must be at most 512Mi`)))
+				})
+				It("should deny a request exceeding its limit", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newTestPod("default", "inverted-resources", withIraAnnotations(map[string]string{
+						"ira.ontsys.com/memory-request": "256Mi",
+					})))).To(MatchError(ContainSubstring("the memory request of the credential helper (256Mi) must not exceed its limit (128Mi)")))
+				})
+			})
+			Context("when a role session name template is configured", func() {
+				AfterEach(func() {
+					RoleSessionNameTemplate = ""
+				})
+				It("should pass the role session name of the pod to the credential helper", func() {
+					RoleSessionNameTemplate = "{namespace}.{pod}"
 					ctx := context.Background()
 					pod := &v1.Pod{
 						ObjectMeta: metav1.ObjectMeta{
 							Annotations: map[string]string{
-								"ira.ontsys.com/trust-anchor": "ta",
-								"ira.ontsys.com/profile":      "p",
-								"ira.ontsys.com/role":         "c",
-								"ira.ontsys.com/cert":         "cert-name",
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
 							},
-							Name:      "named-cert",
+							GenerateName: "session-",
+							Namespace:    "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(ContainElement(And(
+						HaveField("Args", ContainElements("--role-session-name", "default.$(IRA_POD_NAME)")),
+						HaveField("Env", ContainElement(HaveField("ValueFrom.FieldRef.FieldPath", "metadata.name"))),
+						HaveField("StartupProbe.Exec.Command", Not(ContainElement("--role-session-name"))),
+					)))
+				})
+			})
+			Context("when the pod requests additional roles", func() {
+				It("should inject a credential helper for each role", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+								"ira.ontsys.com/roles":        `{"backup": {"role": "arn:aws:iam::123456789012:role/backup", "containers": ["backup-agent"]}}`,
+							},
+							Name:      "multiple-roles",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+								{
+									Name:  "backup-agent",
+									Image: "backup-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.Volumes).To(ContainElements(
+						HaveField("VolumeSource.Secret.SecretName", "multiple-roles-ira"),
+						And(HaveField("Name", "ira-cert-backup"), HaveField("VolumeSource.Secret.SecretName", "multiple-roles-ira-backup")),
+					))
+					Expect(pod.Spec.InitContainers).To(ContainElements(
+						And(HaveField("Name", "ira"), HaveField("Args", ContainElements("--role-arn", roleArn, "--port", "9911"))),
+						And(
+							HaveField("Name", "ira-backup"),
+							HaveField("Args", ContainElements("--certificate", "/ira-cert-backup/tls.crt", "--role-arn", "arn:aws:iam::123456789012:role/backup", "--port", "9912")),
+							HaveField("VolumeMounts", ContainElement(HaveField("MountPath", "/ira-cert-backup"))),
+						),
+					))
+					Expect(pod.Spec.Containers).To(HaveExactElements(
+						HaveField("Env", ContainElement(v1.EnvVar{Name: "AWS_EC2_METADATA_SERVICE_ENDPOINT", Value: "http://127.0.0.1:9911"})),
+						HaveField("Env", ContainElement(v1.EnvVar{Name: "AWS_EC2_METADATA_SERVICE_ENDPOINT", Value: "http://127.0.0.1:9912"})),
+					))
+				})
+				It("should deny the pod when a role is mapped to a missing container", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+								"ira.ontsys.com/roles":        `{"backup": {"role": "arn:aws:iam::123456789012:role/backup", "containers": ["backup-agent"]}}`,
+							},
+							Name:      "missing-role-container",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(MatchError(ContainSubstring(`container "backup-agent" of role "backup"`)))
+				})
+			})
+			Context("when the pod is updated after being mutated", func() {
+				It("should not inject the credential helper again", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+							Name:      "updated",
 							Namespace: "default",
 						},
 						Spec: v1.PodSpec{
@@ -209,59 +367,1365 @@ var _ = Describe("Pod Webhook", func() {
 					}
 					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
 
-					Eventually(func() *gbytes.Buffer {
-						return buffer
-					}, 5*time.Second, 25*time.Millisecond).Should(gbytes.Say("Attempting to patch pod"))
+					mutatedPod := getPod(ctx, "default", "updated")
+					Expect(mutatedPod.Annotations).To(HaveKeyWithValue("ira.ontsys.com/injected", "true"))
 
-					mutatedPod := &v1.Pod{}
-					Eventually(func() bool {
-						err := k8sClient.Get(ctx, types.NamespacedName{
+					mutatedPod.Labels = map[string]string{"updated": "true"}
+					delete(mutatedPod.Annotations, "ira.ontsys.com/injected")
+					Expect(k8sClient.Update(ctx, mutatedPod)).To(Succeed())
+
+					updatedPod := getPod(ctx, "default", "updated")
+					Expect(updatedPod.Labels).To(HaveKeyWithValue("updated", "true"))
+					Expect(updatedPod.Annotations).To(HaveKeyWithValue("ira.ontsys.com/injected", "true"))
+					Expect(updatedPod.Spec.Volumes).To(HaveExactElements(HaveField("Name", Equal("ira-cert"))))
+					Expect(updatedPod.Spec.InitContainers).To(HaveExactElements(HaveField("Name", Equal("ira"))))
+					Expect(updatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", HaveExactElements(
+						v1.EnvVar{
+							Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+							Value: "http://127.0.0.1:9911",
+						},
+						v1.EnvVar{
+							Name:  "AWS_REGION",
+							Value: "us-east-1",
+						},
+						v1.EnvVar{
+							Name:  "AWS_DEFAULT_REGION",
+							Value: "us-east-1",
+						},
+					))))
+				})
+			})
+			Context("when a mutated pod is created again", func() {
+				It("should reconcile the credential helper instead of denying the pod", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+							Name:      "recreated",
 							Namespace: "default",
-							Name:      "named-cert",
-						}, mutatedPod)
-						return err == nil
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(k8sClient.Delete(ctx, pod, client.GracePeriodSeconds(0))).To(Succeed())
+					Eventually(func() bool {
+						return apierrors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), &v1.Pod{}))
 					}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
-					Expect(mutatedPod.Spec.Volumes).To(ContainElement(HaveField("VolumeSource.Secret.SecretName", "cert-name")))
+
+					// the exported pod, with the credential helper the webhook injected, is created again
+					recreatedPod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: pod.Annotations,
+							Name:        "recreated",
+							Namespace:   "default",
+						},
+						Spec: pod.Spec,
+					}
+					Expect(k8sClient.Create(ctx, recreatedPod)).To(Succeed())
+					Expect(recreatedPod.Annotations).To(HaveKeyWithValue("ira.ontsys.com/injected", "true"))
+					Expect(recreatedPod.Spec.Volumes).To(HaveExactElements(HaveField("Name", Equal("ira-cert"))))
+					Expect(recreatedPod.Spec.InitContainers).To(HaveExactElements(HaveField("Name", Equal("ira"))))
+					Expect(recreatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", HaveExactElements(
+						v1.EnvVar{
+							Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+							Value: "http://127.0.0.1:9911",
+						},
+						v1.EnvVar{
+							Name:  "AWS_REGION",
+							Value: "us-east-1",
+						},
+						v1.EnvVar{
+							Name:  "AWS_DEFAULT_REGION",
+							Value: "us-east-1",
+						},
+					))))
 				})
 			})
-		})
-		Context("with IRA annotations and requiring a trailing slash", func() {
-			It("should mutate the pod", func() {
-				ctx := context.Background()
-				pod := &v1.Pod{
-					ObjectMeta: metav1.ObjectMeta{
-						Annotations: map[string]string{
-							"ira.ontsys.com/trust-anchor":                     "ta",
-							"ira.ontsys.com/profile":                          "p",
-							"ira.ontsys.com/role":                             "c",
-							"ira.ontsys.com/metadata-endpoint-trailing-slash": "true",
+			Context("when the pod defines a container using the reserved name", func() {
+				It("should deny the pod", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+							Name:      "reserved-container",
+							Namespace: "default",
 						},
-						Name:      "annotated-trailing",
-						Namespace: "default",
-					},
-					Spec: v1.PodSpec{
-						Containers: []v1.Container{
-							{
-								Name:  "my-container",
-								Image: "my-image",
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "ira",
+									Image: "my-image",
+								},
 							},
 						},
-					},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(MatchError(ContainSubstring(`container name "ira" is reserved`)))
+				})
+				It("should deny the pod even when it claims to be injected", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+								"ira.ontsys.com/injected":     "true",
+							},
+							Name:      "reserved-container-injected",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "ira",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(MatchError(ContainSubstring(`container name "ira" is reserved`)))
+				})
+			})
+			Context("when the pod defines a volume using the reserved name", func() {
+				It("should deny the pod", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+							Name:      "reserved-volume",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+							Volumes: []v1.Volume{
+								{
+									Name: "ira-cert",
+									VolumeSource: v1.VolumeSource{
+										EmptyDir: &v1.EmptyDirVolumeSource{},
+									},
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(MatchError(ContainSubstring(`volume name "ira-cert" is reserved`)))
+				})
+			})
+			Context("when containers are selected for injection", func() {
+				endpointEnv := v1.EnvVar{
+					Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+					Value: "http://127.0.0.1:9911",
 				}
-				Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+				newPod := func(name string, annotations map[string]string) *v1.Pod {
+					pod := newTestPod("default", name, withIraAnnotations(annotations))
+					pod.Spec.Containers = []v1.Container{
+						{
+							Name:  "app",
+							Image: "my-image",
+						},
+						{
+							Name:  "log-shipper",
+							Image: "my-image",
+						},
+						{
+							Name:  "proxy",
+							Image: "my-image",
+						},
+					}
+					return pod
+				}
+				It("should only inject the included containers", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("included", map[string]string{
+						"ira.ontsys.com/containers": "app, proxy",
+					}))).To(Succeed())
 
-				Eventually(func() *gbytes.Buffer {
-					return buffer
-				}, 5*time.Second, 25*time.Millisecond).Should(gbytes.Say("Attempting to patch pod"))
+					mutatedPod := getPod(ctx, "default", "included")
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(
+						HaveField("Env", ContainElement(endpointEnv)),
+						HaveField("Env", Not(ContainElement(endpointEnv))),
+						HaveField("Env", ContainElement(endpointEnv)),
+					))
+				})
+				It("should not inject the excluded containers", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("excluded", map[string]string{
+						"ira.ontsys.com/exclude-containers": "log-shipper,proxy",
+					}))).To(Succeed())
 
-				mutatedPod := &v1.Pod{}
-				Eventually(func() bool {
-					err := k8sClient.Get(ctx, types.NamespacedName{
-						Namespace: "default",
-						Name:      "annotated-trailing",
-					}, mutatedPod)
-					return err == nil
-				}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+					mutatedPod := getPod(ctx, "default", "excluded")
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(
+						HaveField("Env", ContainElement(endpointEnv)),
+						HaveField("Env", Not(ContainElement(endpointEnv))),
+						HaveField("Env", Not(ContainElement(endpointEnv))),
+					))
+				})
+				It("should deny a pod selecting a container that doesn't exist", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("missing-container", map[string]string{
+						"ira.ontsys.com/containers": "app,missing",
+					}))).To(MatchError(ContainSubstring(`container "missing" listed in ira.ontsys.com/containers does not exist`)))
+				})
+			})
+			Context("when init containers should use the credential helper", func() {
+				It("should place the credential helper first and inject the init containers", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor":    trustAnchorArn,
+								"ira.ontsys.com/profile":         profileArn,
+								"ira.ontsys.com/role":            roleArn,
+								"ira.ontsys.com/init-containers": "true",
+							},
+							Name:      "init-containers",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							InitContainers: []v1.Container{
+								{
+									Name:  "migrate",
+									Image: "my-image",
+								},
+							},
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "init-containers")
+					Expect(mutatedPod.Spec.InitContainers).To(HaveExactElements(
+						HaveField("Name", Equal("ira")),
+						And(HaveField("Name", Equal("migrate")), HaveField("Env", ContainElement(v1.EnvVar{
+							Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+							Value: "http://127.0.0.1:9911",
+						}))),
+					))
+				})
+			})
+			Context("when an ephemeral container is added", func() {
+				It("should configure the ephemeral container", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+							Name:      "debugged",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "debugged")
+					mutatedPod.Spec.EphemeralContainers = append(mutatedPod.Spec.EphemeralContainers, v1.EphemeralContainer{
+						EphemeralContainerCommon: v1.EphemeralContainerCommon{
+							Name:                     "debugger",
+							Image:                    "my-image",
+							TerminationMessagePolicy: v1.TerminationMessageReadFile,
+							ImagePullPolicy:          v1.PullIfNotPresent,
+						},
+					})
+					Expect(k8sClient.SubResource("ephemeralcontainers").Update(ctx, mutatedPod)).To(Succeed())
+
+					debuggedPod := getPod(ctx, "default", "debugged")
+					Expect(debuggedPod.Spec.EphemeralContainers).To(HaveExactElements(HaveField("Env", ContainElement(v1.EnvVar{
+						Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+						Value: "http://127.0.0.1:9911",
+					}))))
+				})
+				It("should deny an ephemeral container targeting a container of an additional role", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+								"ira.ontsys.com/roles":        `{"backup": {"role": "arn:aws:iam::123456789012:role/backup", "containers": ["backup-agent"]}}`,
+							},
+							Name:      "debugged-role",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+								{
+									Name:  "backup-agent",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, v1.EphemeralContainer{
+						EphemeralContainerCommon: v1.EphemeralContainerCommon{
+							Name:                     "debugger",
+							Image:                    "my-image",
+							TerminationMessagePolicy: v1.TerminationMessageReadFile,
+							ImagePullPolicy:          v1.PullIfNotPresent,
+						},
+						TargetContainerName: "backup-agent",
+					})
+					Expect(k8sClient.SubResource("ephemeralcontainers").Update(ctx, pod)).To(MatchError(ContainSubstring(`ephemeral container "debugger" targets container "backup-agent" of an additional role`)))
+				})
+			})
+			Context("when using the process credentials mode", func() {
+				It("should install the credential helper and configure the containers to use it as a credential process", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor":    trustAnchorArn,
+								"ira.ontsys.com/profile":         profileArn,
+								"ira.ontsys.com/role":            roleArn,
+								"ira.ontsys.com/credential-mode": "process",
+							},
+							Name:      "process-mode",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "process-mode")
+					Expect(mutatedPod.Spec.Volumes).To(ContainElements(
+						HaveField("Name", Equal("ira-cert")),
+						And(HaveField("Name", Equal("ira-config")), HaveField("VolumeSource.EmptyDir", Not(BeNil()))),
+					))
+					Expect(mutatedPod.Spec.InitContainers).To(HaveExactElements(And(
+						HaveField("Name", Equal("ira")),
+						HaveField("RestartPolicy", BeNil()),
+						HaveField("StartupProbe", BeNil()),
+						HaveField("Command", HaveExactElements("sh", "-c", ContainSubstring("/ira/aws_signing_helper"))),
+						HaveField("Env", ContainElement(v1.EnvVar{
+							Name: "IRA_AWS_CONFIG",
+							Value: "[default]\ncredential_process = /ira/aws_signing_helper credential-process " +
+								"--certificate /ira-cert/tls.crt --private-key /ira-cert/tls.key " +
+								"--trust-anchor-arn " + trustAnchorArn + " --profile-arn " + profileArn + " --role-arn " + roleArn + " --session-duration 900 --region us-east-1",
+						})),
+						HaveField("VolumeMounts", HaveExactElements(HaveField("Name", Equal("ira-config")))),
+					)))
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(And(
+						HaveField("Env", ContainElement(v1.EnvVar{
+							Name:  "AWS_CONFIG_FILE",
+							Value: "/ira/config",
+						})),
+						HaveField("Env", Not(ContainElement(HaveField("Name", Equal("AWS_EC2_METADATA_SERVICE_ENDPOINT"))))),
+						HaveField("VolumeMounts", ContainElements(
+							v1.VolumeMount{Name: "ira-config", MountPath: "/ira", ReadOnly: true},
+							v1.VolumeMount{Name: "ira-cert", MountPath: "/ira-cert", ReadOnly: true},
+						)),
+					)))
+				})
+			})
+			Context("when using the container credentials mode", func() {
+				BeforeEach(func() {
+					CredentialAdapterImage = "ira-controller:latest"
+					DeferCleanup(func() {
+						CredentialAdapterImage = ""
+					})
+				})
+				It("should inject the credential adapter and configure the containers to use the container credentials provider", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor":    trustAnchorArn,
+								"ira.ontsys.com/profile":         profileArn,
+								"ira.ontsys.com/role":            roleArn,
+								"ira.ontsys.com/credential-mode": "container",
+							},
+							Name:      "container-mode",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							// the service account admission plugin, which sets the default service account, isn't enabled
+							ServiceAccountName: "default",
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "container-mode")
+					Expect(mutatedPod.Spec.Volumes).To(ContainElement(And(
+						HaveField("Name", Equal("ira-token")),
+						HaveField("VolumeSource.Projected.Sources", HaveExactElements(HaveField("ServiceAccountToken.Audience", Equal("ira.ontsys.com")))),
+					)))
+					Expect(mutatedPod.Spec.InitContainers).To(HaveExactElements(
+						And(
+							HaveField("Name", Equal("ira")),
+							HaveField("Command", HaveExactElements("aws_signing_helper")),
+							HaveField("Args", ContainElements("serve", "--port", "9911")),
+						),
+						And(
+							HaveField("Name", Equal("ira-adapter")),
+							HaveField("Image", Equal("ira-controller:latest")),
+							HaveField("RestartPolicy", HaveValue(Equal(v1.ContainerRestartPolicyAlways))),
+							HaveField("Command", HaveExactElements("/ira-controller", "credential-adapter")),
+							HaveField("Args", HaveExactElements(
+								"--port", "9912",
+								"--metadata-endpoint", "http://127.0.0.1:9911",
+								"--authorization-token-file", "/var/run/secrets/ira.ontsys.com/serviceaccount/token",
+							)),
+							HaveField("StartupProbe.Exec.Command", ContainElement("--probe")),
+							HaveField("VolumeMounts", HaveExactElements(HaveField("Name", Equal("ira-token")))),
+						),
+					))
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(And(
+						HaveField("Env", ContainElements(
+							v1.EnvVar{
+								Name:  "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+								Value: "http://127.0.0.1:9912/",
+							},
+							v1.EnvVar{
+								Name:  "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+								Value: "/var/run/secrets/ira.ontsys.com/serviceaccount/token",
+							},
+						)),
+						HaveField("Env", Not(ContainElement(HaveField("Name", Equal("AWS_EC2_METADATA_SERVICE_ENDPOINT"))))),
+						HaveField("VolumeMounts", HaveExactElements(
+							v1.VolumeMount{Name: "ira-token", MountPath: "/var/run/secrets/ira.ontsys.com/serviceaccount", ReadOnly: true},
+						)),
+					)))
+				})
+				It("should deny the pod when the credential adapter image isn't configured", func() {
+					ctx := context.Background()
+					CredentialAdapterImage = ""
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor":    trustAnchorArn,
+								"ira.ontsys.com/profile":         profileArn,
+								"ira.ontsys.com/role":            roleArn,
+								"ira.ontsys.com/credential-mode": "container",
+							},
+							Name:      "container-mode-without-adapter",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(MatchError(ContainSubstring("the container credential mode requires the credential adapter image to be configured")))
+				})
+			})
+			Context("when using an invalid credential mode", func() {
+				It("should deny the pod", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor":    trustAnchorArn,
+								"ira.ontsys.com/profile":         profileArn,
+								"ira.ontsys.com/role":            roleArn,
+								"ira.ontsys.com/credential-mode": "ecs",
+							},
+							Name:      "invalid-mode",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/credential-mode]: Unsupported value: "ecs"`)))
+				})
+			})
+			Context("when the ARNs are invalid", func() {
+				newPod := func(name string, trustAnchor string, profile string, role string) *v1.Pod {
+					return newTestPod("default", name, map[string]string{
+						"ira.ontsys.com/trust-anchor": trustAnchor,
+						"ira.ontsys.com/profile":      profile,
+						"ira.ontsys.com/role":         role,
+					})
+				}
+				It("should deny a value that isn't an ARN", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("not-an-arn", "ta", profileArn, roleArn))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/trust-anchor]: Invalid value: "ta": "ta" is not an ARN`)))
+				})
+				It("should deny swapped ARNs", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("swapped-arns", profileArn, trustAnchorArn, roleArn))).To(MatchError(And(
+						ContainSubstring("metadata.annotations[ira.ontsys.com/trust-anchor]: Invalid value: %q: must be the ARN of a rolesanywhere trust-anchor but is the ARN of a rolesanywhere profile", profileArn),
+						ContainSubstring("metadata.annotations[ira.ontsys.com/profile]: Invalid value: %q: must be the ARN of a rolesanywhere profile but is the ARN of a rolesanywhere trust-anchor", trustAnchorArn),
+					)))
+				})
+				It("should deny a role ARN containing a region", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("regional-role", trustAnchorArn, profileArn, "arn:aws:iam:us-east-1:123456789012:role/c"))).To(MatchError(ContainSubstring("IAM ARNs must not contain a region")))
+				})
+				It("should deny ARNs in different partitions", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("mismatched-partition", trustAnchorArn, profileArn, "arn:aws-us-gov:iam::123456789012:role/c"))).To(MatchError(ContainSubstring("role is in partition aws-us-gov but the trust anchor is in partition aws")))
+				})
+				It("should deny ARNs in different accounts", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("mismatched-account", trustAnchorArn, profileArn, "arn:aws:iam::210987654321:role/c"))).To(MatchError(ContainSubstring("role is in account 210987654321 but the profile is in account 123456789012")))
+				})
+				It("should deny a trust anchor and profile in different regions", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("mismatched-region", trustAnchorArn, "arn:aws:rolesanywhere:us-west-2:123456789012:profile/p", roleArn))).To(MatchError(ContainSubstring("profile is in region us-west-2 but the trust anchor is in region us-east-1")))
+				})
+			})
+			Context("when the default port is used by a container", func() {
+				It("should use the next free port", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+							Name:      "port-in-use",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+									Args:  []string{"--listen=:9912"},
+									Ports: []v1.ContainerPort{
+										{
+											ContainerPort: 9911,
+										},
+									},
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "port-in-use")
+					Expect(mutatedPod.Annotations).To(HaveKeyWithValue("ira.ontsys.com/port", "9913"))
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", ContainElement(v1.EnvVar{
+						Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+						Value: "http://127.0.0.1:9913",
+					}))))
+					Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Args", ContainElements("--port", "9913"))))
+				})
+			})
+			Context("when a port is requested", func() {
+				newPod := func(name string, port string) *v1.Pod {
+					pod := newTestPod("default", name, withIraAnnotations(map[string]string{
+						"ira.ontsys.com/port": port,
+					}))
+					pod.Spec.Containers[0].Ports = []v1.ContainerPort{
+						{
+							ContainerPort: 8080,
+						},
+					}
+					return pod
+				}
+				It("should use the requested port", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("requested-port", "8081"))).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "requested-port")
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", ContainElement(v1.EnvVar{
+						Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+						Value: "http://127.0.0.1:8081",
+					}))))
+					Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Args", ContainElements("--port", "8081"))))
+				})
+				It("should deny the pod when the requested port is in use", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("conflicting-port", "8080"))).To(MatchError(ContainSubstring(`port 8080 in ira.ontsys.com/port is already used by container "my-container"`)))
+				})
+				It("should deny the pod when the requested port is invalid", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("invalid-port", "http"))).To(MatchError(ContainSubstring(`port "http" in ira.ontsys.com/port is invalid`)))
+				})
+			})
+			Context("when the pod uses the host network", func() {
+				newPod := func(name string) *v1.Pod {
+					pod := newTestPod("default", name, withIraAnnotations(map[string]string{}))
+					pod.Spec.HostNetwork = true
+					return pod
+				}
+				It("should deny the pod when no host network port range is configured", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("host-network-denied"))).To(MatchError(ContainSubstring("pods using the host network require a port")))
+				})
+				It("should allocate a port from the host network port range", func() {
+					HostNetworkPortRange = "30000-30009"
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("host-network"))).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "host-network")
+					port, err := helperPort(newPod("host-network"), nil, "")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(port).To(And(BeNumerically(">=", 30000), BeNumerically("<=", 30009)))
+					Expect(mutatedPod.Annotations).To(HaveKeyWithValue("ira.ontsys.com/port", strconv.Itoa(port)))
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", ContainElement(v1.EnvVar{
+						Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+						Value: fmt.Sprintf("http://127.0.0.1:%d", port),
+					}))))
+				})
+				It("should declare the port as a host port so that pods sharing it aren't placed on the same node", func() {
+					HostNetworkPortRange = "30100-30100"
+					ctx := context.Background()
+					for _, name := range []string{"host-network-a", "host-network-b"} {
+						pod := newPod(name)
+						pod.Spec.NodeName = "node-a"
+						Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+						// both pods are given the only port of the range, the host port keeps the scheduler and the kubelet
+						// from running them side by side
+						Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Ports", HaveExactElements(v1.ContainerPort{
+							ContainerPort: 30100,
+							HostPort:      30100,
+							Protocol:      v1.ProtocolTCP,
+						}))))
+					}
+				})
+			})
+			Context("when using classic sidecars", func() {
+				newPod := func(name string, restartPolicy v1.RestartPolicy, annotations map[string]string) *v1.Pod {
+					pod := newTestPod("default", name, withIraAnnotations(annotations))
+					pod.Spec.RestartPolicy = restartPolicy
+					return pod
+				}
+				BeforeEach(func() {
+					SidecarMode = "classic"
+				})
+				It("should inject the credential helper as a regular container", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("classic", v1.RestartPolicyAlways, map[string]string{}))).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "classic")
+					Expect(mutatedPod.Spec.InitContainers).To(BeEmpty())
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(
+						And(HaveField("Name", Equal("my-container")), HaveField("Env", ContainElement(v1.EnvVar{
+							Name:  "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+							Value: "http://127.0.0.1:9911",
+						}))),
+						And(HaveField("Name", Equal("ira")), HaveField("RestartPolicy", BeNil()), HaveField("Env", BeEmpty()), HaveField("StartupProbe", BeNil())),
+					))
+				})
+				It("should use the process credential mode for pods that don't restart", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("classic-batch", v1.RestartPolicyNever, map[string]string{}))).To(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "classic-batch")
+					Expect(mutatedPod.Spec.InitContainers).To(HaveExactElements(And(
+						HaveField("Name", Equal("ira")),
+						HaveField("Command", ContainElement("sh")),
+					)))
+					Expect(mutatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", ContainElement(v1.EnvVar{
+						Name:  "AWS_CONFIG_FILE",
+						Value: "/ira/config",
+					}))))
+				})
+				It("should deny pods requiring credentials in init containers", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("classic-init", v1.RestartPolicyAlways, map[string]string{
+						"ira.ontsys.com/init-containers": "true",
+					}))).To(MatchError(ContainSubstring("ira.ontsys.com/init-containers requires the process credential mode")))
+				})
+			})
+			Context("when referencing an IRAProfile", func() {
+				BeforeEach(func() {
+					port := int32(9950)
+					profile := &irav1alpha1.IRAProfile{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "shared",
+							Namespace: "default",
+						},
+						Spec: irav1alpha1.IRAProfileSpec{
+							TrustAnchor:     trustAnchorArn,
+							Profile:         profileArn,
+							Role:            roleArn,
+							SessionDuration: "1800",
+							Helper: &irav1alpha1.HelperOverrides{
+								Port: &port,
+							},
+						},
+					}
+					Expect(client.IgnoreAlreadyExists(k8sClient.Create(context.Background(), profile))).To(Succeed())
+				})
+				It("should mutate the pod using the configuration of the profile", func() {
+					ctx := context.Background()
+					Eventually(func() error {
+						return k8sClient.Create(ctx, newTestPod("default", "profile-ref", map[string]string{
+							"ira.ontsys.com/profile-ref": "shared",
+						}))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "profile-ref")
+					Expect(mutatedPod.Spec.InitContainers).To(HaveExactElements(HaveField("Args", ContainElements(
+						trustAnchorArn, profileArn, roleArn, "--session-duration", "1800", "--port", "9950",
+					))))
+				})
+				It("should prefer the annotations of the pod", func() {
+					ctx := context.Background()
+					Eventually(func() error {
+						return k8sClient.Create(ctx, newTestPod("default", "profile-ref-override", map[string]string{
+							"ira.ontsys.com/profile-ref": "shared",
+							"ira.ontsys.com/port":        "9960",
+						}))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "profile-ref-override")
+					Expect(mutatedPod.Spec.InitContainers).To(HaveExactElements(HaveField("Args", ContainElements("--port", "9960"))))
+				})
+				It("should deny the pod when the profile doesn't exist", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newTestPod("default", "missing-profile-ref", map[string]string{
+						"ira.ontsys.com/profile-ref": "missing",
+					}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/profile-ref]: Not found: "missing"`)))
+				})
+			})
+			Context("when using an IRAClass", func() {
+				It("should use the defaults of the selected class", func() {
+					ctx := context.Background()
+					class := &irav1alpha1.IRAClass{
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "selected",
+						},
+						Spec: irav1alpha1.IRAClassSpec{
+							TrustAnchor:     trustAnchorArn,
+							SessionDuration: "3600",
+							Helper: &irav1alpha1.ClassHelperSpec{
+								Image: "class-image:latest",
+								Resources: &v1.ResourceRequirements{
+									Requests: v1.ResourceList{
+										v1.ResourceCPU:    resource.MustParse("50m"),
+										v1.ResourceMemory: resource.MustParse("16Mi"),
+									},
+									Limits: v1.ResourceList{
+										v1.ResourceMemory: resource.MustParse("32Mi"),
+									},
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, class)).To(Succeed())
+					Eventually(func() error {
+						return k8sClient.Create(ctx, newTestPod("default", "selected-class", map[string]string{
+							"ira.ontsys.com/class":   "selected",
+							"ira.ontsys.com/profile": profileArn,
+							"ira.ontsys.com/role":    roleArn,
+						}))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+
+					mutatedPod := getPod(ctx, "default", "selected-class")
+					Expect(mutatedPod.Spec.InitContainers).To(HaveExactElements(And(
+						HaveField("Image", Equal("class-image:latest")),
+						HaveField("Args", ContainElements(trustAnchorArn, profileArn, roleArn, "--session-duration", "3600")),
+						HaveField("Resources", Equal(v1.ResourceRequirements{
+							Requests: v1.ResourceList{
+								v1.ResourceCPU:    resource.MustParse("50m"),
+								v1.ResourceMemory: resource.MustParse("16Mi"),
+							},
+							Limits: v1.ResourceList{
+								v1.ResourceMemory: resource.MustParse("32Mi"),
+							},
+						})),
+					)))
+				})
+				It("should use the defaults of the default class", func() {
+					ctx := context.Background()
+					class := &irav1alpha1.IRAClass{
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "default",
+							Annotations: map[string]string{
+								irav1alpha1.DefaultClassAnnotation: "true",
+							},
+						},
+						Spec: irav1alpha1.IRAClassSpec{
+							Helper: &irav1alpha1.ClassHelperSpec{
+								Image: "default-class-image:latest",
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, class)).To(Succeed())
+					DeferCleanup(func() {
+						Expect(k8sClient.Delete(context.Background(), class)).To(Succeed())
+					})
+
+					Eventually(func(g Gomega) {
+						pod := newTestPod("default", "default-class", map[string]string{
+							"ira.ontsys.com/trust-anchor": trustAnchorArn,
+							"ira.ontsys.com/profile":      profileArn,
+							"ira.ontsys.com/role":         roleArn,
+						})
+						pod.GenerateName = "default-class-"
+						pod.Name = ""
+						g.Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+						g.Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Image", Equal("default-class-image:latest"))))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+				It("should deny the pod when the class doesn't exist", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newTestPod("default", "missing-class", map[string]string{
+						"ira.ontsys.com/class":        "missing",
+						"ira.ontsys.com/trust-anchor": trustAnchorArn,
+						"ira.ontsys.com/profile":      profileArn,
+						"ira.ontsys.com/role":         roleArn,
+					}))).To(MatchError(ContainSubstring(`metadata.annotations[ira.ontsys.com/class]: Not found: "missing"`)))
+				})
+				It("should deny a pod choosing the image of its credential helper without the validating webhook", func() {
+					ctx := context.Background()
+					raw, err := json.Marshal(newTestPod("default", "pod-image", map[string]string{
+						"ira.ontsys.com/trust-anchor": trustAnchorArn,
+						"ira.ontsys.com/profile":      profileArn,
+						"ira.ontsys.com/role":         roleArn,
+						"ira.ontsys.com/image":        "my-image",
+					}))
+					Expect(err).NotTo(HaveOccurred())
+
+					response := NewPodIraInjector(k8sClient, k8sscheme.Scheme).Handle(ctx, admission.Request{
+						AdmissionRequest: admissionv1.AdmissionRequest{
+							Operation: admissionv1.Create,
+							Namespace: "default",
+							Object:    runtime.RawExtension{Raw: raw},
+						},
+					})
+					Expect(response.Allowed).To(BeFalse())
+					Expect(response.Patches).To(BeEmpty())
+					Expect(response.Result.Message).To(ContainSubstring("metadata.annotations[ira.ontsys.com/image]: Forbidden: may only be provided by an IRAClass"))
+				})
+			})
+			Context("when the namespace provides IRA annotations", func() {
+				BeforeEach(func() {
+					namespace := &v1.Namespace{
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "ira-defaults",
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+						},
+					}
+					Expect(client.IgnoreAlreadyExists(k8sClient.Create(context.Background(), namespace))).To(Succeed())
+				})
+				It("should mutate a pod without IRA annotations using the annotations of the namespace", func() {
+					ctx := context.Background()
+					Eventually(func(g Gomega) {
+						pod := newTestPod("ira-defaults", "", nil)
+						pod.GenerateName = "namespace-defaults-"
+						g.Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+						g.Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Args", ContainElements(trustAnchorArn, profileArn, roleArn))))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+				It("should prefer the annotations of the pod", func() {
+					ctx := context.Background()
+					role := "arn:aws:iam::123456789012:role/other"
+					Eventually(func(g Gomega) {
+						pod := newTestPod("ira-defaults", "", map[string]string{
+							"ira.ontsys.com/role": role,
+						})
+						pod.GenerateName = "namespace-override-"
+						g.Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+						g.Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Args", ContainElements(trustAnchorArn, profileArn, role))))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+				It("should skip a pod that opted out", func() {
+					ctx := context.Background()
+					pod := newTestPod("ira-defaults", "opted-out", map[string]string{
+						"ira.ontsys.com/inject": "false",
+					})
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(BeEmpty())
+					Expect(pod.Spec.Containers).To(HaveExactElements(HaveField("Env", BeEmpty())))
+				})
+			})
+			Context("when the service account provides IRA annotations", func() {
+				BeforeEach(func() {
+					ctx := context.Background()
+					namespace := &v1.Namespace{
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "ira-service-accounts",
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+							},
+						},
+					}
+					Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, namespace))).To(Succeed())
+					serviceAccount := &v1.ServiceAccount{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "ira",
+							Namespace: "ira-service-accounts",
+							Annotations: map[string]string{
+								"ira.ontsys.com/role": roleArn,
+							},
+						},
+					}
+					Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, serviceAccount))).To(Succeed())
+					irsaServiceAccount := &v1.ServiceAccount{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "irsa",
+							Namespace: "ira-service-accounts",
+							Annotations: map[string]string{
+								"eks.amazonaws.com/role-arn": "arn:aws:iam::123456789012:role/irsa",
+							},
+						},
+					}
+					Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, irsaServiceAccount))).To(Succeed())
+				})
+				AfterEach(func() {
+					util.TranslateIrsaAnnotations = false
+				})
+				newPod := func(serviceAccount string) *v1.Pod {
+					pod := newTestPod("ira-service-accounts", "", nil)
+					pod.GenerateName = serviceAccount + "-"
+					pod.Spec.ServiceAccountName = serviceAccount
+					return pod
+				}
+				It("should mutate a pod without IRA annotations using the annotations of its service account", func() {
+					ctx := context.Background()
+					Eventually(func(g Gomega) {
+						pod := newPod("ira")
+						g.Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+						g.Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Args", ContainElements(trustAnchorArn, profileArn, roleArn))))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+				It("should use the IRSA role of the service account when translation is enabled", func() {
+					ctx := context.Background()
+					util.TranslateIrsaAnnotations = true
+					Eventually(func(g Gomega) {
+						pod := newPod("irsa")
+						g.Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+						g.Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Args", ContainElements(trustAnchorArn, profileArn, "arn:aws:iam::123456789012:role/irsa"))))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+				It("should ignore the IRSA role of the service account when translation is disabled", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("irsa"))).To(MatchError(ContainSubstring("metadata.annotations[ira.ontsys.com/role]: Required value")))
+				})
+			})
+			Context("when the root workload provides IRA annotations", func() {
+				It("should mutate a pod without IRA annotations using the annotations of its workload", func() {
+					ctx := context.Background()
+					deployment := &appsv1.Deployment{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "inherited",
+							Namespace: "default",
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+						},
+						Spec: appsv1.DeploymentSpec{
+							Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "inherited"}},
+							Template: v1.PodTemplateSpec{
+								ObjectMeta: metav1.ObjectMeta{
+									Labels: map[string]string{"app": "inherited"},
+								},
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, deployment)).To(Succeed())
+
+					Eventually(func(g Gomega) {
+						pod := &v1.Pod{
+							ObjectMeta: metav1.ObjectMeta{
+								GenerateName:    "inherited-",
+								Namespace:       "default",
+								OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+							},
+							Spec: v1.PodSpec{
+								Containers: []v1.Container{
+									{
+										Name:  "my-container",
+										Image: "my-image",
+									},
+								},
+							},
+						}
+						g.Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+						g.Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Args", ContainElements(trustAnchorArn, profileArn, roleArn))))
+						g.Expect(pod.Spec.Volumes).To(ContainElement(HaveField("VolumeSource.Secret.SecretName", "inherited-deployment-ira")))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+				It("should mutate a pod whose owner reference doesn't say whether the owner is its controller", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+							},
+							Name:      "owner-without-controller",
+							Namespace: "default",
+							OwnerReferences: []metav1.OwnerReference{
+								{
+									APIVersion: "apps/v1",
+									Kind:       "Deployment",
+									Name:       "inherited",
+									UID:        "00000000-0000-0000-0000-000000000000",
+								},
+							},
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("Name", "ira")))
+					Expect(pod.Spec.Volumes).To(ContainElement(HaveField("VolumeSource.Secret.SecretName", "owner-without-controller-ira")))
+				})
+			})
+			Context("with a sidecar template", func() {
+				BeforeEach(func() {
+					Expect(LoadSidecarTemplate(&v1.ConfigMap{
+						Data: map[string]string{
+							"sidecar.yaml":               "imagePullPolicy: Always\nenv:\n- name: HTTPS_PROXY\n  value: http://proxy:3128\n",
+							"sidecar.ira-templates.yaml": "env:\n- name: HTTPS_PROXY\n  value: http://other-proxy:3128\n",
+						},
+					})).To(Succeed())
+				})
+				AfterEach(func() {
+					Expect(LoadSidecarTemplate(nil)).To(Succeed())
+				})
+				newPod := func(namespace string) *v1.Pod {
+					pod := newTestPod(namespace, "", withIraAnnotations(map[string]string{}))
+					pod.GenerateName = "templated-"
+					return pod
+				}
+				It("should merge the template over the credential helper", func() {
+					ctx := context.Background()
+					pod := newPod("default")
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(HaveExactElements(And(
+						HaveField("Name", "ira"),
+						HaveField("Image", "test-image:latest"),
+						HaveField("ImagePullPolicy", v1.PullAlways),
+						HaveField("Env", ContainElement(v1.EnvVar{Name: "HTTPS_PROXY", Value: "http://proxy:3128"})),
+					)))
+				})
+				It("should allow metadata updates of pods injected before the template changed", func() {
+					ctx := context.Background()
+					Expect(LoadSidecarTemplate(nil)).To(Succeed())
+					pod := newPod("default")
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(LoadSidecarTemplate(&v1.ConfigMap{
+						Data: map[string]string{
+							"sidecar.yaml": "imagePullPolicy: Never\n",
+						},
+					})).To(Succeed())
+					pod.Labels = map[string]string{"updated": "true"}
+					Expect(k8sClient.Update(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("ImagePullPolicy", Not(Equal(v1.PullNever)))))
+				})
+				It("should merge the template of the namespace over the template of every pod", func() {
+					ctx := context.Background()
+					namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ira-templates"}}
+					Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, namespace))).To(Succeed())
+					pod := newPod("ira-templates")
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(HaveExactElements(And(
+						HaveField("ImagePullPolicy", v1.PullAlways),
+						HaveField("Env", ContainElement(v1.EnvVar{Name: "HTTPS_PROXY", Value: "http://other-proxy:3128"})),
+						HaveField("Env", Not(ContainElement(v1.EnvVar{Name: "HTTPS_PROXY", Value: "http://proxy:3128"}))),
+					)))
+				})
+				It("should keep the template in use when loading an invalid template", func() {
+					Expect(LoadSidecarTemplate(&v1.ConfigMap{
+						Data: map[string]string{"sidecar.yaml": "imagePullPolicy: Never\nunknown: true\n"},
+					})).To(MatchError(ContainSubstring("sidecar template sidecar.yaml is invalid")))
+					Expect(LoadSidecarTemplate(&v1.ConfigMap{
+						Data: map[string]string{"sidecar.yaml": "name: other\n"},
+					})).To(MatchError(ContainSubstring("the name of the ira container can't be changed")))
+					Expect(LoadSidecarTemplate(&v1.ConfigMap{
+						Data: map[string]string{"template": "imagePullPolicy: Never\n"},
+					})).To(MatchError(ContainSubstring(`sidecar template key "template" is invalid`)))
+
+					ctx := context.Background()
+					pod := newPod("default")
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("ImagePullPolicy", v1.PullAlways)))
+				})
+			})
+			Context("when the namespace enforces a Pod Security Standard", func() {
+				BeforeEach(func() {
+					ctx := context.Background()
+					for name, level := range map[string]string{"ira-restricted": "restricted", "ira-baseline": "baseline"} {
+						namespace := &v1.Namespace{
+							ObjectMeta: metav1.ObjectMeta{
+								Name:   name,
+								Labels: map[string]string{"pod-security.kubernetes.io/enforce": level},
+							},
+						}
+						Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, namespace))).To(Succeed())
+					}
+				})
+				AfterEach(func() {
+					Expect(LoadSidecarTemplate(nil)).To(Succeed())
+				})
+				newPod := func(namespace string) *v1.Pod {
+					pod := newTestPod(namespace, "", withIraAnnotations(map[string]string{}))
+					pod.GenerateName = "pod-security-"
+					pod.Spec.Containers[0].SecurityContext = helperSecurityContext()
+					return pod
+				}
+				It("should inject a credential helper complying with the restricted standard", func() {
+					ctx := context.Background()
+					pod := newPod("ira-restricted")
+					Eventually(func() error {
+						return k8sClient.Create(ctx, pod)
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+					Expect(pod.Spec.InitContainers).To(HaveExactElements(HaveField("SecurityContext", And(
+						HaveField("AllowPrivilegeEscalation", HaveValue(BeFalse())),
+						HaveField("Capabilities.Drop", ConsistOf(v1.Capability("ALL"))),
+						HaveField("ReadOnlyRootFilesystem", HaveValue(BeTrue())),
+						HaveField("RunAsNonRoot", HaveValue(BeTrue())),
+						HaveField("SeccompProfile.Type", v1.SeccompProfileTypeRuntimeDefault),
+					))))
+				})
+				It("should run the credential helper as a non-root user whatever the user of its image", func() {
+					ctx := context.Background()
+					pod := newPod("default")
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+					Expect(pod.Spec.InitContainers).To(HaveExactElements(And(
+						HaveField("Image", "test-image:latest"),
+						HaveField("SecurityContext", And(
+							HaveField("RunAsNonRoot", HaveValue(BeTrue())),
+							HaveField("RunAsUser", HaveValue(BeEquivalentTo(65532))),
+							HaveField("RunAsGroup", HaveValue(BeEquivalentTo(65532))),
+						)),
+					)))
+				})
+				It("should deny a pod whose credential helper would violate the standard of its namespace", func() {
+					ctx := context.Background()
+					Expect(LoadSidecarTemplate(&v1.ConfigMap{
+						Data: map[string]string{"sidecar.yaml": "securityContext:\n  allowPrivilegeEscalation: true\n"},
+					})).To(Succeed())
+					Expect(k8sClient.Create(ctx, newPod("ira-restricted"))).To(MatchError(ContainSubstring(`the ira container would violate the "restricted" Pod Security Standard enforced in namespace ira-restricted: allowPrivilegeEscalation must be false`)))
+				})
+				It("should only apply the checks of the standard of the namespace", func() {
+					ctx := context.Background()
+					Expect(LoadSidecarTemplate(&v1.ConfigMap{
+						Data: map[string]string{"sidecar.yaml": "securityContext:\n  allowPrivilegeEscalation: true\n"},
+					})).To(Succeed())
+					Eventually(func() error {
+						return k8sClient.Create(ctx, newPod("ira-baseline"))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+			})
+			Context("when role policies are enforced", func() {
+				BeforeEach(func() {
+					policy := &irav1alpha1.IRAPolicy{
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "apps",
+						},
+						Spec: irav1alpha1.IRAPolicySpec{
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"kubernetes.io/metadata.name": "default"},
+							},
+							PodSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"team": "apps"},
+							},
+							AllowedRoles:    []string{"arn:aws:iam::123456789012:role/app-*"},
+							AllowedProfiles: []string{profileArn},
+						},
+					}
+					Expect(client.IgnoreAlreadyExists(k8sClient.Create(context.Background(), policy))).To(Succeed())
+					util.EnforceRolePolicies = true
+				})
+				AfterEach(func() {
+					util.EnforceRolePolicies = false
+				})
+				newPod := func(name string, team string, role string) *v1.Pod {
+					pod := newTestPod("default", name, withIraAnnotations(map[string]string{}))
+					pod.Annotations["ira.ontsys.com/role"] = role
+					pod.Labels = map[string]string{"team": team}
+					return pod
+				}
+				It("should mutate a pod using an allowed role", func() {
+					ctx := context.Background()
+					Eventually(func() error {
+						return k8sClient.Create(ctx, newPod("allowed-role", "apps", "arn:aws:iam::123456789012:role/app-reader"))
+					}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+				})
+				It("should deny a pod using a role that isn't allowed", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("unauthorized-role", "apps", "arn:aws:iam::123456789012:role/admin"))).To(MatchError(ContainSubstring("not authorized by any IRAPolicy")))
+				})
+				It("should deny a pod that isn't selected by a policy", func() {
+					ctx := context.Background()
+					Expect(k8sClient.Create(ctx, newPod("unselected-pod", "other", "arn:aws:iam::123456789012:role/app-reader"))).To(MatchError(ContainSubstring("not authorized by any IRAPolicy")))
+				})
+				Context("scoping the policy to service accounts", func() {
+					BeforeEach(func() {
+						ctx := context.Background()
+						namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ira-policy"}}
+						Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, namespace))).To(Succeed())
+						policy := &irav1alpha1.IRAPolicy{
+							ObjectMeta: metav1.ObjectMeta{
+								Name: "service-accounts",
+							},
+							Spec: irav1alpha1.IRAPolicySpec{
+								ServiceAccounts: []string{"ira-policy/app"},
+								AllowedRoles:    []string{"arn:aws:iam::123456789012:role/service-account-*"},
+							},
+						}
+						Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, policy))).To(Succeed())
+					})
+					newServiceAccountPod := func(name string, namespace string) *v1.Pod {
+						pod := newPod(name, "other", "arn:aws:iam::123456789012:role/service-account-reader")
+						pod.Namespace = namespace
+						pod.Spec.ServiceAccountName = "app"
+						return pod
+					}
+					It("should mutate a pod running as an allowed service account", func() {
+						ctx := context.Background()
+						Eventually(func() error {
+							return k8sClient.Create(ctx, newServiceAccountPod("allowed-service-account", "ira-policy"))
+						}, 5*time.Second, 25*time.Millisecond).Should(Succeed())
+					})
+					It("should deny a pod running as a service account of the same name in another namespace", func() {
+						ctx := context.Background()
+						Expect(k8sClient.Create(ctx, newServiceAccountPod("same-named-service-account", "default"))).To(MatchError(ContainSubstring("for service account default/app is not authorized by any IRAPolicy")))
+					})
+				})
+			})
+			Context("using a provided certificate name", func() {
+				It("should mutate the pod using the provided certificate name", func() {
+					ctx := context.Background()
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": trustAnchorArn,
+								"ira.ontsys.com/profile":      profileArn,
+								"ira.ontsys.com/role":         roleArn,
+								"ira.ontsys.com/cert":         "cert-name",
+							},
+							Name:      "named-cert",
+							Namespace: "default",
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					Eventually(func() *gbytes.Buffer {
+						return buffer
+					}, 5*time.Second, 25*time.Millisecond).Should(gbytes.Say("Attempting to patch pod"))
+
+					mutatedPod := getPod(ctx, "default", "named-cert")
+					Expect(mutatedPod.Spec.Volumes).To(ContainElement(HaveField("VolumeSource.Secret.SecretName", "cert-name")))
+				})
+			})
+		})
+		Context("with IRA annotations and requiring a trailing slash", func() {
+			It("should mutate the pod", func() {
+				ctx := context.Background()
+				pod := &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							"ira.ontsys.com/trust-anchor":                     trustAnchorArn,
+							"ira.ontsys.com/profile":                          profileArn,
+							"ira.ontsys.com/role":                             roleArn,
+							"ira.ontsys.com/metadata-endpoint-trailing-slash": "true",
+						},
+						Name:      "annotated-trailing",
+						Namespace: "default",
+					},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{
+							{
+								Name:  "my-container",
+								Image: "my-image",
+							},
+						},
+					},
+				}
+				Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+				Eventually(func() *gbytes.Buffer {
+					return buffer
+				}, 5*time.Second, 25*time.Millisecond).Should(gbytes.Say("Attempting to patch pod"))
+
+				mutatedPod := getPod(ctx, "default", "annotated-trailing")
 				Expect(mutatedPod.Spec.Volumes).To(ContainElement(HaveField("Name", Equal("ira-cert"))))
 				Expect(mutatedPod.Spec.Volumes).To(ContainElement(HaveField("VolumeSource.Secret.SecretName", "annotated-trailing-ira")))
 				Expect(mutatedPod.Spec.Containers).To(HaveExactElements(HaveField("Env", ContainElement(v1.EnvVar{
@@ -273,7 +1737,7 @@ var _ = Describe("Pod Webhook", func() {
 					Name:      "ira-cert",
 					MountPath: "/ira-cert",
 				}))))
-				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Args", ContainElements("ta", "p", "c"))))
+				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Args", ContainElements(trustAnchorArn, profileArn, roleArn))))
 				Expect(mutatedPod.Spec.InitContainers).To(ContainElement(HaveField("Resources", v1.ResourceRequirements{
 					Limits: v1.ResourceList{
 						v1.ResourceMemory: resource.MustParse("128Mi"),
@@ -0,0 +1,65 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"net/http"
+
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
+	"github.com/ontariosystems/ira-controller/internal/util"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var (
+	policylog                          = logf.Log.WithName("irapolicy-resource")
+	_         webhook.AdmissionHandler = &policyIraValidator{}
+)
+
+// +kubebuilder:webhook:path=/validate-ira-ontsys-com-v1alpha1-irapolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=ira.ontsys.com,resources=irapolicies,verbs=create;update,versions=v1alpha1,name=virapolicy.kb.io,admissionReviewVersions=v1
+
+// policyIraValidator struct used to validate the selectors and patterns of IRAPolicies
+type policyIraValidator struct {
+	decoder admission.Decoder
+}
+
+// NewPolicyIraValidator initializes and returns a new IRAPolicy validator to handle webhook calls
+func NewPolicyIraValidator(scheme *runtime.Scheme) admission.Handler {
+	return &policyIraValidator{
+		decoder: admission.NewDecoder(scheme),
+	}
+}
+
+// Handle rejects IRAPolicies that couldn't be used to authorize pods
+func (p *policyIraValidator) Handle(_ context.Context, request admission.Request) admission.Response {
+	policy := &irav1alpha1.IRAPolicy{}
+	if err := p.decoder.Decode(request, policy); err != nil {
+		policylog.Error(err, "error occurred while decoding the admission request")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if errs := util.ValidatePolicy(policy.Spec, field.NewPath("spec")); len(errs) > 0 {
+		policylog.Info("Denying invalid IRAPolicy", "policy name", policy.Name, "reason", errs.ToAggregate().Error())
+		return invalidResponse(schema.GroupKind{Group: irav1alpha1.GroupVersion.Group, Kind: "IRAPolicy"}, policy.Name, errs)
+	}
+	return admission.Allowed("")
+}
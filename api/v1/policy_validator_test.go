@@ -0,0 +1,74 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("IRAPolicy Validator", func() {
+	newPolicy := func(name string, spec irav1alpha1.IRAPolicySpec) *irav1alpha1.IRAPolicy {
+		spec.AllowedRoles = []string{"arn:aws:iam::123456789012:role/validated-*"}
+		return &irav1alpha1.IRAPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+			},
+			Spec: spec,
+		}
+	}
+	It("should allow a valid policy", func() {
+		ctx := context.Background()
+		Expect(k8sClient.Create(ctx, newPolicy("valid-policy", irav1alpha1.IRAPolicySpec{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"team": "a"},
+			},
+			ServiceAccounts: []string{"team-a/my-app"},
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "my-app"},
+			},
+		}))).To(Succeed())
+	})
+	It("should deny a policy with an invalid selector", func() {
+		ctx := context.Background()
+		Expect(k8sClient.Create(ctx, newPolicy("invalid-selector-policy", irav1alpha1.IRAPolicySpec{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "team", Operator: "Equals", Values: []string{"a"}},
+				},
+			},
+		}))).To(MatchError(ContainSubstring(`spec.namespaceSelector: Invalid value`)))
+	})
+	It("should deny a policy selecting pods in any namespace", func() {
+		ctx := context.Background()
+		Expect(k8sClient.Create(ctx, newPolicy("unscoped-pod-selector-policy", irav1alpha1.IRAPolicySpec{
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "my-app"},
+			},
+		}))).To(MatchError(ContainSubstring("namespaceSelector is required with podSelector")))
+	})
+	It("should deny a policy with a service account missing its namespace", func() {
+		ctx := context.Background()
+		Expect(k8sClient.Create(ctx, newPolicy("unscoped-service-account-policy", irav1alpha1.IRAPolicySpec{
+			ServiceAccounts: []string{"default"},
+		}))).To(MatchError(ContainSubstring("spec.serviceAccounts[0]")))
+	})
+})
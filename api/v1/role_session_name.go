@@ -0,0 +1,163 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ontariosystems/ira-controller/internal/util"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// namespacePlaceholder, podPlaceholder, serviceAccountPlaceholder and workloadPlaceholder are replaced by the
+	// identity of the pod in the role session name template
+	namespacePlaceholder      = "{namespace}"
+	podPlaceholder            = "{pod}"
+	serviceAccountPlaceholder = "{service-account}"
+	workloadPlaceholder       = "{workload}"
+
+	// podNameEnv is the environment variable of the credential helper holding the name of the pod, which is provided
+	// by the downward API because pods with a generated name don't have one yet when they are admitted
+	podNameEnv = "IRA_POD_NAME"
+	// podNameReference expands to the name of the pod in the arguments and environment variables of the credential
+	// helper container
+	podNameReference = "$(" + podNameEnv + ")"
+
+	// maxRoleSessionNameLength and minRoleSessionNameLength are the bounds STS enforces on the length of role session
+	// names
+	maxRoleSessionNameLength = 64
+	minRoleSessionNameLength = 2
+	// maxGeneratedNameBaseLength and generatedNameSuffixLength are the lengths the API server uses to generate the
+	// names of objects from their generateName
+	maxGeneratedNameBaseLength = 58
+	generatedNameSuffixLength  = 5
+)
+
+var (
+	// RoleSessionNameTemplate is the template of the role session name of the credentials obtained by the credential
+	// helper, the credential helper uses its default (the serial number of the certificate) when it is empty
+	RoleSessionNameTemplate string
+
+	// roleSessionNamePlaceholders are the placeholders supported by the role session name template
+	roleSessionNamePlaceholders = sets.New(namespacePlaceholder, podPlaceholder, serviceAccountPlaceholder, workloadPlaceholder)
+	// placeholderPattern matches the placeholders of the role session name template
+	placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+	// invalidSessionNameCharacters matches the characters STS doesn't accept in role session names
+	invalidSessionNameCharacters = regexp.MustCompile(`[^\w+=,.@-]`)
+)
+
+// ValidateRoleSessionNameTemplate verifies that the role session name template only uses the supported placeholders
+// and uses the name of the pod at most once
+func ValidateRoleSessionNameTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		if !roleSessionNamePlaceholders.Has(placeholder) {
+			return fmt.Errorf("role session name template placeholder %s is invalid, it must be one of (%s)", placeholder, strings.Join(sets.List(roleSessionNamePlaceholders), ","))
+		}
+	}
+	if strings.Count(template, podPlaceholder) > 1 {
+		return fmt.Errorf("role session name template may only use %s once", podPlaceholder)
+	}
+	return nil
+}
+
+// roleSessionName renders the role session name template for the pod.  Its name is referenced through the downward
+// API so that the same role session name is rendered whether or not the name has been generated yet, and the rest of
+// the template is truncated to leave room for the longest name the pod can have.  Only the names of pods that are longer
+// than any generated name are truncated and rendered as is.
+func roleSessionName(ctx context.Context, c client.Reader, namespace string, pod *v1.Pod) (string, error) {
+	if RoleSessionNameTemplate == "" {
+		return "", nil
+	}
+
+	replacements := []string{
+		namespacePlaceholder, namespace,
+		serviceAccountPlaceholder, util.ServiceAccountName(&pod.Spec),
+	}
+	if strings.Contains(RoleSessionNameTemplate, workloadPlaceholder) {
+		workload, err := util.WorkloadName(ctx, c, namespace, pod.OwnerReferences)
+		if err != nil {
+			return "", err
+		}
+		replacements = append(replacements, workloadPlaceholder, workload)
+	}
+	replacer := strings.NewReplacer(replacements...)
+	render := func(text string) string {
+		return invalidSessionNameCharacters.ReplaceAllString(replacer.Replace(text), "-")
+	}
+
+	prefix, suffix, usesPod := strings.Cut(RoleSessionNameTemplate, podPlaceholder)
+	prefix, suffix = render(prefix), render(suffix)
+	podNameLength := podNameLength(pod)
+	if !usesPod || podNameLength > maxGeneratedNameBaseLength+generatedNameSuffixLength {
+		name := prefix
+		if usesPod {
+			name += invalidSessionNameCharacters.ReplaceAllString(pod.Name, "-") + suffix
+		}
+		name = truncate(name, maxRoleSessionNameLength)
+		if len(name) < minRoleSessionNameLength {
+			return "", nil
+		}
+		return name, nil
+	}
+
+	if len(prefix)+podNameLength+len(suffix) < minRoleSessionNameLength {
+		return "", nil
+	}
+	budget := maxRoleSessionNameLength - podNameLength
+	suffix = truncate(suffix, max(0, budget-len(prefix)))
+	prefix = truncate(prefix, budget-len(suffix))
+	return prefix + podNameReference + suffix, nil
+}
+
+// podNameLength returns the length of the name of the pod, or the longest name it can be given when it is generated
+func podNameLength(pod *v1.Pod) int {
+	if pod.Name != "" {
+		return len(pod.Name)
+	}
+	return min(len(pod.GenerateName), maxGeneratedNameBaseLength) + generatedNameSuffixLength
+}
+
+// truncate returns the first length bytes of the text
+func truncate(text string, length int) string {
+	if len(text) > length {
+		return text[:length]
+	}
+	return text
+}
+
+// referencesPodName reports whether the role session name references the name of the pod through the downward API
+func referencesPodName(name string) bool {
+	return strings.Contains(name, podNameReference)
+}
+
+// podNameEnvVar returns the environment variable providing the name of the pod to the credential helper
+func podNameEnvVar() v1.EnvVar {
+	return v1.EnvVar{
+		Name: podNameEnv,
+		ValueFrom: &v1.EnvVarSource{
+			FieldRef: &v1.ObjectFieldSelector{
+				FieldPath: "metadata.name",
+			},
+		},
+	}
+}
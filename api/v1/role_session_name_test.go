@@ -0,0 +1,65 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Role session name", func() {
+	AfterEach(func() {
+		RoleSessionNameTemplate = ""
+	})
+
+	render := func(template string, meta metav1.ObjectMeta) string {
+		RoleSessionNameTemplate = template
+		name, err := roleSessionName(context.Background(), k8sClient, "default", &v1.Pod{
+			ObjectMeta: meta,
+			Spec: v1.PodSpec{
+				ServiceAccountName: "my-service-account",
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return name
+	}
+
+	It("should not be rendered without a template", func() {
+		Expect(render("", metav1.ObjectMeta{Name: "my-pod"})).To(BeEmpty())
+	})
+	It("should reference the name of the pod through the downward API", func() {
+		Expect(render("{namespace}.{service-account}.{pod}", metav1.ObjectMeta{GenerateName: "my-pod-"})).To(Equal("default.my-service-account.$(IRA_POD_NAME)"))
+	})
+	It("should replace the characters STS doesn't accept", func() {
+		Expect(render("ns:{namespace}/{workload}", metav1.ObjectMeta{Name: "my-pod"})).To(Equal("ns-default-"))
+	})
+	It("should leave room for the longest name the pod can be generated with", func() {
+		Expect(render(strings.Repeat("a", 40)+"-{pod}-"+strings.Repeat("b", 20), metav1.ObjectMeta{GenerateName: "my-pod-"})).
+			To(Equal(strings.Repeat("a", 40) + "-$(IRA_POD_NAME)-" + strings.Repeat("b", 10)))
+	})
+	It("should truncate names longer than any generated name", func() {
+		Expect(render("{namespace}.{pod}", metav1.ObjectMeta{Name: strings.Repeat("p", 70)})).To(Equal("default." + strings.Repeat("p", 56)))
+	})
+	It("should reject unknown placeholders", func() {
+		Expect(ValidateRoleSessionNameTemplate("{namespace}.{pod-name}")).To(MatchError(ContainSubstring("placeholder {pod-name} is invalid")))
+	})
+})
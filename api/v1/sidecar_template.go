@@ -0,0 +1,145 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	// sidecarTemplateKey is the key of the sidecar template ConfigMap holding the template used for every pod
+	sidecarTemplateKey = "sidecar.yaml"
+	// namespaceTemplatePrefix and namespaceTemplateSuffix surround the namespace in the keys of the sidecar template
+	// ConfigMap holding the template used for the pods of a namespace (e.g. sidecar.my-app.yaml)
+	namespaceTemplatePrefix = "sidecar."
+	namespaceTemplateSuffix = ".yaml"
+)
+
+var (
+	// SidecarTemplate is the namespace/name of the ConfigMap holding the partial container specs that are merged over
+	// the injected credential helper container.  No template is used when it is empty.
+	SidecarTemplate string
+
+	sidecarTemplatesLock sync.RWMutex
+	// sidecarTemplates are the templates of the sidecar template ConfigMap as JSON patches keyed by namespace, the
+	// template used for every pod has an empty key
+	sidecarTemplates map[string][]byte
+)
+
+// LoadSidecarTemplate validates the templates of the sidecar template ConfigMap and uses them for the credential helper
+// containers injected afterwards.  The templates in use are kept when the ConfigMap is invalid and removed when it is
+// nil.
+func LoadSidecarTemplate(configMap *v1.ConfigMap) error {
+	templates := make(map[string][]byte)
+	if configMap != nil {
+		for key, value := range configMap.Data {
+			namespace, err := templateNamespace(key)
+			if err != nil {
+				return err
+			}
+			patch, err := parseSidecarTemplate(value)
+			if err != nil {
+				return fmt.Errorf("sidecar template %s is invalid: %w", key, err)
+			}
+			templates[namespace] = patch
+		}
+	}
+
+	sidecarTemplatesLock.Lock()
+	defer sidecarTemplatesLock.Unlock()
+	sidecarTemplates = templates
+	return nil
+}
+
+// templateNamespace returns the namespace whose pods use the template with the key of the sidecar template ConfigMap
+func templateNamespace(key string) (string, error) {
+	if key == sidecarTemplateKey {
+		return "", nil
+	}
+	namespace, ok := strings.CutPrefix(key, namespaceTemplatePrefix)
+	if ok {
+		namespace, ok = strings.CutSuffix(namespace, namespaceTemplateSuffix)
+	}
+	if !ok || namespace == "" {
+		return "", fmt.Errorf("sidecar template key %q is invalid, it must be %s or %s<namespace>%s", key, sidecarTemplateKey, namespaceTemplatePrefix, namespaceTemplateSuffix)
+	}
+	return namespace, nil
+}
+
+// parseSidecarTemplate parses a partial container spec in YAML or JSON and returns it as a strategic merge patch.  The
+// template may not rename the container and must merge cleanly over a credential helper container.
+func parseSidecarTemplate(template string) ([]byte, error) {
+	patch, err := yaml.ToJSON([]byte(template))
+	if err != nil {
+		return nil, err
+	}
+	container := &v1.Container{}
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(container); err != nil {
+		return nil, err
+	}
+	if container.Name != "" {
+		return nil, fmt.Errorf("the name of the %s container can't be changed", helperContainerName)
+	}
+	if _, err := mergeSidecarTemplate(v1.Container{Name: helperContainerName}, patch); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// applySidecarTemplate merges the template used for every pod and then the template of the namespace over the
+// credential helper container
+func applySidecarTemplate(container v1.Container, namespace string) (v1.Container, error) {
+	sidecarTemplatesLock.RLock()
+	defer sidecarTemplatesLock.RUnlock()
+
+	var err error
+	for _, key := range []string{"", namespace} {
+		if patch, ok := sidecarTemplates[key]; ok {
+			if container, err = mergeSidecarTemplate(container, patch); err != nil {
+				return container, fmt.Errorf("unable to apply the sidecar template: %w", err)
+			}
+		}
+	}
+	return container, nil
+}
+
+// mergeSidecarTemplate returns the container with the strategic merge patch of a template applied
+func mergeSidecarTemplate(container v1.Container, patch []byte) (v1.Container, error) {
+	original, err := json.Marshal(container)
+	if err != nil {
+		return container, err
+	}
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, v1.Container{})
+	if err != nil {
+		return container, err
+	}
+	result := v1.Container{}
+	if err := json.Unmarshal(merged, &result); err != nil {
+		return container, err
+	}
+	return result, nil
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	cmv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/ontariosystems/ira-controller/internal/util"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// arnAnnotations are the annotations that must all be provided for a pod to use IAM Roles Anywhere
+	arnAnnotations = []string{"ira.ontsys.com/trust-anchor", "ira.ontsys.com/profile", "ira.ontsys.com/role"}
+	// knownAnnotations are all the annotations understood by the webhook and the controller
+	knownAnnotations = sets.New(
+		"ira.ontsys.com/cert",
+		"ira.ontsys.com/cpu-limit",
+		"ira.ontsys.com/cpu-request",
+		"ira.ontsys.com/containers",
+		"ira.ontsys.com/credential-mode",
+		"ira.ontsys.com/debug",
+		"ira.ontsys.com/endpoint",
+		"ira.ontsys.com/exclude-containers",
+		"ira.ontsys.com/image",
+		"ira.ontsys.com/init-containers",
+		"ira.ontsys.com/intermediates",
+		"ira.ontsys.com/issuer-kind",
+		"ira.ontsys.com/issuer-name",
+		"ira.ontsys.com/memory-limit",
+		"ira.ontsys.com/memory-request",
+		"ira.ontsys.com/metadata-endpoint-trailing-slash",
+		"ira.ontsys.com/port",
+		"ira.ontsys.com/region",
+		"ira.ontsys.com/role-session-name",
+		"ira.ontsys.com/session-duration",
+		"ira.ontsys.com/with-proxy",
+		injectedAnnotation,
+		util.ClassAnnotation,
+		util.InjectAnnotation,
+		util.ProfileRefAnnotation,
+		util.RolesAnnotation,
+	).Insert(arnAnnotations...)
+	// classAnnotations are the annotations that can only be provided by an IRAClass
+	classAnnotations = sets.New(
+		"ira.ontsys.com/image",
+	)
+)
+
+// validateAnnotations verifies the ira.ontsys.com annotations are complete, known and contain valid values
+func validateAnnotations(annotations map[string]string, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	for _, annotation := range sets.List(sets.KeySet(annotations)) {
+		if strings.HasPrefix(annotation, util.AnnotationPrefix) && !knownAnnotations.Has(annotation) {
+			errs = append(errs, field.Forbidden(path.Key(annotation), "unknown IRA annotation"))
+		}
+	}
+
+	var missing []string
+	for _, annotation := range arnAnnotations {
+		if !util.MapContains(annotations, annotation) {
+			missing = append(missing, annotation)
+		}
+	}
+	if len(missing) == 0 {
+		errs = append(errs, validateRoleArns(annotations, path)...)
+	} else if len(missing) < len(arnAnnotations) {
+		for _, annotation := range missing {
+			errs = append(errs, field.Required(path.Key(annotation), fmt.Sprintf("all of %s must be provided", strings.Join(arnAnnotations, ", "))))
+		}
+	} else if util.MapContains(annotations, util.RolesAnnotation) {
+		errs = append(errs, field.Forbidden(path.Key(util.RolesAnnotation), fmt.Sprintf("additional roles require all of %s", strings.Join(arnAnnotations, ", "))))
+	}
+
+	if _, err := credentialMode(annotations); err != nil {
+		errs = append(errs, field.NotSupported(path.Key("ira.ontsys.com/credential-mode"), annotations["ira.ontsys.com/credential-mode"], CredentialModes))
+	}
+
+	if value, ok := annotations[util.InjectAnnotation]; ok && value != "true" {
+		errs = append(errs, field.NotSupported(path.Key(util.InjectAnnotation), value, []string{"false", "true"}))
+	}
+
+	for _, annotation := range booleanAnnotations {
+		if value, ok := annotations[annotation]; ok && value != "false" && value != "true" {
+			errs = append(errs, field.NotSupported(path.Key(annotation), value, []string{"false", "true"}))
+		}
+	}
+
+	for annotation, validate := range map[string]func(string) error{
+		"ira.ontsys.com/endpoint":          validateEndpoint,
+		"ira.ontsys.com/region":            validateRegion,
+		"ira.ontsys.com/role-session-name": validateRoleSessionName,
+	} {
+		if value, ok := annotations[annotation]; ok {
+			if err := validate(value); err != nil {
+				errs = append(errs, field.Invalid(path.Key(annotation), value, err.Error()))
+			}
+		}
+	}
+
+	issuerKinds := []string{cmv1.ClusterIssuerKind, cmv1.IssuerKind}
+	if kind, ok := annotations["ira.ontsys.com/issuer-kind"]; ok && !sets.New(issuerKinds...).Has(kind) {
+		errs = append(errs, field.NotSupported(path.Key("ira.ontsys.com/issuer-kind"), kind, issuerKinds))
+	}
+
+	if value, ok := annotations["ira.ontsys.com/session-duration"]; ok {
+		if _, err := parseSessionDuration(value); err != nil {
+			errs = append(errs, field.Invalid(path.Key("ira.ontsys.com/session-duration"), value, err.Error()))
+		}
+	}
+
+	for _, annotation := range sets.List(sets.KeySet(resourceAnnotations)) {
+		if value, ok := annotations[annotation]; ok {
+			if _, err := helperQuantity(annotation, value); err != nil {
+				errs = append(errs, field.Invalid(path.Key(annotation), value, err.Error()))
+			}
+		}
+	}
+
+	return errs
+}
+
+// resolveAnnotations returns the effective IRA annotations, reporting a reference to a missing IRAProfile or IRAClass
+// as an error of the annotation referencing it
+func resolveAnnotations(ctx context.Context, c client.Reader, namespace string, serviceAccount string, workload map[string]string, annotations map[string]string, path *field.Path) (map[string]string, field.ErrorList) {
+	var errs field.ErrorList
+	for _, annotation := range sets.List(classAnnotations) {
+		if util.MapContains(annotations, annotation) {
+			errs = append(errs, field.Forbidden(path.Key(annotation), "may only be provided by an IRAClass"))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	resolved, err := util.ResolveAnnotations(ctx, c, namespace, serviceAccount, workload, annotations)
+	var refErr *util.ReferenceError
+	if errors.As(err, &refErr) && apierrors.IsNotFound(refErr) {
+		return nil, field.ErrorList{field.NotFound(path.Key(refErr.Annotation), refErr.Name)}
+	} else if err != nil {
+		return nil, field.ErrorList{field.InternalError(path, err)}
+	}
+	return resolved, nil
+}
+
+// podWorkloadAnnotations returns the annotations of the root workload of the pod.  The owner references of pods that
+// opted out aren't followed, as the annotations of their workload are ignored anyway.
+func podWorkloadAnnotations(ctx context.Context, c client.Reader, namespace string, pod *v1.Pod) (map[string]string, error) {
+	if util.IsOptedOut(pod.Annotations) {
+		return nil, nil
+	}
+	return util.WorkloadAnnotations(ctx, c, namespace, pod.OwnerReferences)
+}
+
+// validatePodTemplate runs the checks done when a pod is admitted against a pod template of a workload with the
+// workload annotations, so that workloads with templates that would produce pods the webhooks deny can be rejected
+// when they are applied
+func validatePodTemplate(ctx context.Context, c client.Reader, namespace string, workload map[string]string, template *v1.PodTemplateSpec, path *field.Path) field.ErrorList {
+	annotationsPath := path.Child("metadata", "annotations")
+	annotations, errs := resolveAnnotations(ctx, c, namespace, util.ServiceAccountName(&template.Spec), workload, template.Annotations, annotationsPath)
+	if len(errs) > 0 {
+		return errs
+	}
+	errs = validateAnnotations(annotations, annotationsPath)
+	if len(errs) > 0 || !util.MapContains(annotations, "ira.ontsys.com/trust-anchor") {
+		return errs
+	}
+
+	pod := &v1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	if _, err := containerSelector(pod, annotations); err != nil {
+		errs = append(errs, field.Forbidden(annotationsPath, err.Error()))
+	}
+	roles, _ := util.AdditionalRoles(annotations)
+	for _, role := range roles {
+		if _, err := roleContainerSelector(pod, role); err != nil {
+			errs = append(errs, field.Forbidden(annotationsPath.Key(util.RolesAnnotation), err.Error()))
+		}
+	}
+	if helpers, err := newHelperConfigs(pod, annotations, ""); err != nil {
+		errs = append(errs, field.Forbidden(annotationsPath, err.Error()))
+	} else {
+		level, err := podSecurityLevel(ctx, c, namespace)
+		if err != nil {
+			errs = append(errs, field.InternalError(path.Child("spec"), err))
+		}
+		var containers []v1.Container
+		var volumes []v1.Volume
+		for _, helper := range helpers {
+			injected, err := helper.injectedContainers(namespace)
+			if err != nil {
+				errs = append(errs, field.InternalError(annotationsPath, err))
+			}
+			for _, container := range injected {
+				if err := checkPodSecurity(level, namespace, pod, container); err != nil {
+					errs = append(errs, field.Forbidden(path.Child("spec"), err.Error()))
+				} else {
+					containers = append(containers, container)
+				}
+			}
+			for _, volume := range helper.volumes("") {
+				if volume.Secret != nil {
+					// the certificate of the pods is only named once they are created
+					volume.Secret.SecretName = ""
+				}
+				volumes = append(volumes, volume)
+			}
+		}
+		if err := checkReservedNames(pod, containers, volumes); err != nil {
+			errs = append(errs, field.Forbidden(path.Child("spec"), err.Error()))
+		}
+	}
+	if err := util.AuthorizeRole(ctx, c, namespace, pod, annotations); errors.Is(err, util.ErrUnauthorized) {
+		errs = append(errs, field.Forbidden(annotationsPath.Key("ira.ontsys.com/role"), err.Error()))
+	} else if err != nil {
+		errs = append(errs, field.InternalError(annotationsPath, err))
+	}
+	for _, role := range roles {
+		if err := util.AuthorizeRole(ctx, c, namespace, pod, role.Annotations(annotations)); errors.Is(err, util.ErrUnauthorized) {
+			errs = append(errs, field.Forbidden(annotationsPath.Key(util.RolesAnnotation).Key(role.Name), err.Error()))
+		} else if err != nil {
+			errs = append(errs, field.InternalError(annotationsPath, err))
+		}
+	}
+	return errs
+}
+
+// validateRoleArns verifies the ARNs of the primary role of the pod and then those of each of its additional roles,
+// reporting an invalid ira.ontsys.com/roles annotation
+func validateRoleArns(annotations map[string]string, path *field.Path) field.ErrorList {
+	errs := validateArns(annotations, path)
+	if len(errs) > 0 {
+		return errs
+	}
+	roles, err := util.AdditionalRoles(annotations)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path.Key(util.RolesAnnotation), annotations[util.RolesAnnotation], err.Error())}
+	}
+	for _, role := range roles {
+		errs = append(errs, validateArns(role.Annotations(annotations), path.Key(util.RolesAnnotation).Key(role.Name))...)
+	}
+	return errs
+}
+
+// validateArns verifies that the trust anchor, profile and role annotations contain ARNs of the expected resource
+// types and that they are consistent with each other, as IAM Roles Anywhere requires the trust anchor and profile to be
+// in the same partition, account and region and the role to be in the account of the profile.
+func validateArns(annotations map[string]string, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	trustAnchor, trustAnchorErrs := parseArnAnnotation(annotations, "ira.ontsys.com/trust-anchor", "rolesanywhere", "trust-anchor", path)
+	profile, profileErrs := parseArnAnnotation(annotations, "ira.ontsys.com/profile", "rolesanywhere", "profile", path)
+	role, roleErrs := parseArnAnnotation(annotations, "ira.ontsys.com/role", "iam", "role", path)
+	errs = append(errs, trustAnchorErrs...)
+	errs = append(errs, profileErrs...)
+	errs = append(errs, roleErrs...)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	profilePath := path.Key("ira.ontsys.com/profile")
+	rolePath := path.Key("ira.ontsys.com/role")
+	if profile.Partition != trustAnchor.Partition {
+		errs = append(errs, field.Invalid(profilePath, annotations["ira.ontsys.com/profile"], fmt.Sprintf("profile is in partition %s but the trust anchor is in partition %s", profile.Partition, trustAnchor.Partition)))
+	}
+	if role.Partition != trustAnchor.Partition {
+		errs = append(errs, field.Invalid(rolePath, annotations["ira.ontsys.com/role"], fmt.Sprintf("role is in partition %s but the trust anchor is in partition %s", role.Partition, trustAnchor.Partition)))
+	}
+	if profile.AccountID != trustAnchor.AccountID {
+		errs = append(errs, field.Invalid(profilePath, annotations["ira.ontsys.com/profile"], fmt.Sprintf("profile is in account %s but the trust anchor is in account %s", profile.AccountID, trustAnchor.AccountID)))
+	}
+	if role.AccountID != profile.AccountID {
+		errs = append(errs, field.Invalid(rolePath, annotations["ira.ontsys.com/role"], fmt.Sprintf("role is in account %s but the profile is in account %s", role.AccountID, profile.AccountID)))
+	}
+	if profile.Region != trustAnchor.Region {
+		errs = append(errs, field.Invalid(profilePath, annotations["ira.ontsys.com/profile"], fmt.Sprintf("profile is in region %s but the trust anchor is in region %s", profile.Region, trustAnchor.Region)))
+	}
+	return errs
+}
+
+// parseArnAnnotation parses the ARN in the annotation verifying it is for the expected service and resource type
+func parseArnAnnotation(annotations map[string]string, annotation string, service string, resourceType string, path *field.Path) (util.Arn, field.ErrorList) {
+	value := annotations[annotation]
+	annotationPath := path.Key(annotation)
+
+	arn, err := util.ParseArn(value)
+	if err != nil {
+		return arn, field.ErrorList{field.Invalid(annotationPath, value, err.Error())}
+	}
+
+	var errs field.ErrorList
+	if arn.Service != service || arn.ResourceType() != resourceType {
+		errs = append(errs, field.Invalid(annotationPath, value, fmt.Sprintf("must be the ARN of a %s %s but is the ARN of a %s %s", service, resourceType, arn.Service, arn.ResourceType())))
+	}
+	if service == "iam" && arn.Region != "" {
+		errs = append(errs, field.Invalid(annotationPath, value, "IAM ARNs must not contain a region"))
+	}
+	if service != "iam" && arn.Region == "" {
+		errs = append(errs, field.Invalid(annotationPath, value, "must contain a region"))
+	}
+	return arn, errs
+}
@@ -26,12 +26,16 @@ import (
 	"testing"
 	"time"
 
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
 	"github.com/ontariosystems/ira-controller/internal/util"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	// +kubebuilder:scaffold:imports
 	apimachineryruntime "k8s.io/apimachinery/pkg/runtime"
 	k8sscheme "k8s.io/client-go/kubernetes/scheme"
@@ -101,6 +105,9 @@ var _ = BeforeSuite(func() {
 	err = admissionv1.AddToScheme(scheme)
 	Expect(err).NotTo(HaveOccurred())
 
+	err = irav1alpha1.AddToScheme(scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	// +kubebuilder:scaffold:scheme
 
 	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme})
@@ -123,6 +130,12 @@ var _ = BeforeSuite(func() {
 
 	podIraInjector := NewPodIraInjector(mgr.GetClient(), mgr.GetScheme())
 	mgr.GetWebhookServer().Register("/mutate-core-v1-pod", &webhook.Admission{Handler: podIraInjector})
+	podIraValidator := NewPodIraValidator(mgr.GetClient(), mgr.GetScheme())
+	mgr.GetWebhookServer().Register("/validate-core-v1-pod", &webhook.Admission{Handler: podIraValidator})
+	workloadIraValidator := NewWorkloadIraValidator(mgr.GetClient(), mgr.GetScheme())
+	mgr.GetWebhookServer().Register("/validate-workloads", &webhook.Admission{Handler: workloadIraValidator})
+	policyIraValidator := NewPolicyIraValidator(mgr.GetScheme())
+	mgr.GetWebhookServer().Register("/validate-ira-ontsys-com-v1alpha1-irapolicy", &webhook.Admission{Handler: policyIraValidator})
 
 	// +kubebuilder:scaffold:webhook
 
@@ -151,3 +164,39 @@ var _ = AfterSuite(func() {
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
+
+// newTestPod returns a pod with a single container and the annotations
+func newTestPod(namespace string, name string, annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: annotations,
+			Name:        name,
+			Namespace:   namespace,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "my-container",
+					Image: "my-image",
+				},
+			},
+		},
+	}
+}
+
+// withIraAnnotations returns the annotations completed with the trust anchor, profile and role of the tests
+func withIraAnnotations(annotations map[string]string) map[string]string {
+	annotations["ira.ontsys.com/trust-anchor"] = trustAnchorArn
+	annotations["ira.ontsys.com/profile"] = profileArn
+	annotations["ira.ontsys.com/role"] = roleArn
+	return annotations
+}
+
+// getPod waits for the pod to be readable and returns it
+func getPod(ctx context.Context, namespace string, name string) *v1.Pod {
+	pod := &v1.Pod{}
+	Eventually(func() error {
+		return k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, pod)
+	}, 10*time.Second, 25*time.Millisecond).Should(Succeed())
+	return pod
+}
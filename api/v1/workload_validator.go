@@ -0,0 +1,141 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/ontariosystems/ira-controller/internal/util"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var (
+	workloadlog                          = logf.Log.WithName("workload-resource")
+	_           webhook.AdmissionHandler = &workloadIraValidator{}
+)
+
+// +kubebuilder:webhook:path=/validate-workloads,mutating=false,failurePolicy=fail,sideEffects=None,groups=apps;batch,resources=daemonsets;deployments;replicasets;statefulsets;cronjobs;jobs,verbs=create;update,versions=v1,name=vworkload.kb.io,admissionReviewVersions=v1
+
+// workloadIraValidator struct used to validate the IRA annotations of the pod templates of Kubernetes workloads
+type workloadIraValidator struct {
+	Client  client.Client
+	decoder admission.Decoder
+}
+
+// NewWorkloadIraValidator initializes and returns a new workload validator to handle webhook calls
+func NewWorkloadIraValidator(client client.Client, scheme *runtime.Scheme) admission.Handler {
+	return &workloadIraValidator{
+		Client:  client,
+		decoder: admission.NewDecoder(scheme),
+	}
+}
+
+// Handle rejects workloads whose pod template has incomplete or invalid IRA annotations
+func (w *workloadIraValidator) Handle(ctx context.Context, request admission.Request) admission.Response {
+	workload, template, path, err := w.podTemplate(request.Kind, request.Object)
+	if err != nil {
+		workloadlog.Error(err, "error occurred while decoding the admission request")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// Only validate updates that change the IRA annotations so that existing workloads can still be scaled or deleted
+	// after the validation rules change
+	if request.Operation == admissionv1.Update {
+		oldWorkload, oldTemplate, _, err := w.podTemplate(request.Kind, request.OldObject)
+		if err != nil {
+			workloadlog.Error(err, "error occurred while decoding the existing workload")
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if equalIraAnnotations(oldWorkload.GetAnnotations(), workload.GetAnnotations()) && equalIraAnnotations(oldTemplate.Annotations, template.Annotations) {
+			return admission.Allowed("IRA annotations unchanged")
+		}
+	}
+
+	if util.IsOptedOut(template.Annotations) {
+		return admission.Allowed("IRA opted out")
+	}
+
+	// Workloads controlled by another workload (e.g. the Jobs of a CronJob) get their defaults from the root workload
+	annotations, err := util.WorkloadAnnotations(ctx, w.Client, request.Namespace, workload.GetOwnerReferences())
+	if err != nil {
+		workloadlog.Error(err, "error occurred while getting the root workload")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if annotations == nil {
+		annotations = workload.GetAnnotations()
+	}
+
+	if errs := validatePodTemplate(ctx, w.Client, request.Namespace, annotations, template, path); len(errs) > 0 {
+		workloadlog.Info("Denying workload with invalid IRA annotations", "kind", request.Kind.Kind, "name", request.Name, "namespace", request.Namespace, "reason", errs.ToAggregate().Error())
+		return invalidResponse(schema.GroupKind{Group: request.Kind.Group, Kind: request.Kind.Kind}, request.Name, errs)
+	}
+	return admission.Allowed("")
+}
+
+// podTemplate decodes the workload and returns it along with its pod template and the path to it
+func (w *workloadIraValidator) podTemplate(kind metav1.GroupVersionKind, raw runtime.RawExtension) (metav1.Object, *v1.PodTemplateSpec, *field.Path, error) {
+	var (
+		err      error
+		path     = field.NewPath("spec", "template")
+		object   metav1.Object
+		template *v1.PodTemplateSpec
+	)
+	groupKind := schema.GroupKind{Group: kind.Group, Kind: kind.Kind}
+	switch groupKind {
+	case appsv1.SchemeGroupVersion.WithKind("DaemonSet").GroupKind():
+		workload := &appsv1.DaemonSet{}
+		err = w.decoder.DecodeRaw(raw, workload)
+		object, template = workload, &workload.Spec.Template
+	case appsv1.SchemeGroupVersion.WithKind("Deployment").GroupKind():
+		workload := &appsv1.Deployment{}
+		err = w.decoder.DecodeRaw(raw, workload)
+		object, template = workload, &workload.Spec.Template
+	case appsv1.SchemeGroupVersion.WithKind("ReplicaSet").GroupKind():
+		workload := &appsv1.ReplicaSet{}
+		err = w.decoder.DecodeRaw(raw, workload)
+		object, template = workload, &workload.Spec.Template
+	case appsv1.SchemeGroupVersion.WithKind("StatefulSet").GroupKind():
+		workload := &appsv1.StatefulSet{}
+		err = w.decoder.DecodeRaw(raw, workload)
+		object, template = workload, &workload.Spec.Template
+	case batchv1.SchemeGroupVersion.WithKind("CronJob").GroupKind():
+		workload := &batchv1.CronJob{}
+		err = w.decoder.DecodeRaw(raw, workload)
+		object, template = workload, &workload.Spec.JobTemplate.Spec.Template
+		path = field.NewPath("spec", "jobTemplate", "spec", "template")
+	case batchv1.SchemeGroupVersion.WithKind("Job").GroupKind():
+		workload := &batchv1.Job{}
+		err = w.decoder.DecodeRaw(raw, workload)
+		object, template = workload, &workload.Spec.Template
+	default:
+		err = fmt.Errorf("unsupported workload kind %s", groupKind.String())
+	}
+	return object, template, path, err
+}
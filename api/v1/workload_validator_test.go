@@ -0,0 +1,184 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/ontariosystems/ira-controller/internal/util"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Workload Validator", func() {
+	BeforeEach(func() {
+		CredentialHelperImage = "test-image:latest"
+		CredentialHelperCpuRequest = "250m"
+		CredentialHelperMemoryRequest = "64Mi"
+		CredentialHelperMemoryLimit = "128Mi"
+		SessionDuration = "900"
+		CredentialHelperPort = 9911
+	})
+
+	newTemplate := func(annotations map[string]string, containerName string) v1.PodTemplateSpec {
+		return v1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: annotations,
+				Labels:      map[string]string{"app": "workload"},
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{
+						Name:  containerName,
+						Image: "my-image",
+					},
+				},
+				RestartPolicy: v1.RestartPolicyOnFailure,
+			},
+		}
+	}
+	newDeployment := func(name string, annotations map[string]string, containerName string) *appsv1.Deployment {
+		template := newTemplate(annotations, containerName)
+		template.Spec.RestartPolicy = v1.RestartPolicyAlways
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "workload"}},
+				Template: template,
+			},
+		}
+	}
+
+	Context("When creating a workload under Validating Webhook", func() {
+		It("should allow a deployment with valid IRA annotations", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newDeployment("valid-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+			}, "my-container"))).To(Succeed())
+		})
+		It("should deny a deployment with partial IRA annotations", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newDeployment("partial-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+			}, "my-container"))).To(MatchError(ContainSubstring("spec.template.metadata.annotations[ira.ontsys.com/role]: Required value")))
+		})
+		It("should deny a deployment with a template that would be denied by the mutating webhook", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newDeployment("reserved-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+			}, "ira"))).To(MatchError(ContainSubstring(`spec.template.spec: Forbidden: container name "ira" is reserved for the IRA credential helper`)))
+		})
+		It("should deny a deployment selecting a container that doesn't exist", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newDeployment("missing-container-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+				"ira.ontsys.com/containers":   "app",
+			}, "my-container"))).To(MatchError(ContainSubstring(`spec.template.metadata.annotations: Forbidden: container "app" listed in ira.ontsys.com/containers does not exist in the pod`)))
+		})
+		It("should deny a deployment referencing an IRAProfile that doesn't exist", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, newDeployment("missing-profile-deployment", map[string]string{
+				"ira.ontsys.com/profile-ref": "missing",
+			}, "my-container"))).To(MatchError(ContainSubstring(`spec.template.metadata.annotations[ira.ontsys.com/profile-ref]: Not found: "missing"`)))
+		})
+		It("should deny a deployment using a role that isn't allowed by an IRAPolicy", func() {
+			ctx := context.Background()
+			util.EnforceRolePolicies = true
+			DeferCleanup(func() {
+				util.EnforceRolePolicies = false
+			})
+			Expect(k8sClient.Create(ctx, newDeployment("unauthorized-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         "arn:aws:iam::123456789012:role/admin",
+			}, "my-container"))).To(MatchError(ContainSubstring("spec.template.metadata.annotations[ira.ontsys.com/role]: Forbidden: role arn:aws:iam::123456789012:role/admin")))
+		})
+		It("should allow a deployment completing the IRA annotations of its template with its own", func() {
+			ctx := context.Background()
+			deployment := newDeployment("annotated-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+			}, "my-container")
+			deployment.Annotations = map[string]string{
+				"ira.ontsys.com/role": roleArn,
+			}
+			Expect(k8sClient.Create(ctx, deployment)).To(Succeed())
+		})
+		It("should deny a deployment with invalid IRA annotations of its own", func() {
+			ctx := context.Background()
+			deployment := newDeployment("invalid-annotated-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+			}, "my-container")
+			deployment.Annotations = map[string]string{
+				"ira.ontsys.com/role": "arn:aws:iam::123456789012:policy/c",
+			}
+			Expect(k8sClient.Create(ctx, deployment)).To(MatchError(ContainSubstring("spec.template.metadata.annotations[ira.ontsys.com/role]: Invalid value")))
+		})
+		It("should deny a cron job with invalid IRA annotations", func() {
+			ctx := context.Background()
+			cronJob := &batchv1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "invalid-cron-job",
+					Namespace: "default",
+				},
+				Spec: batchv1.CronJobSpec{
+					Schedule: "@daily",
+					JobTemplate: batchv1.JobTemplateSpec{
+						Spec: batchv1.JobSpec{
+							Template: newTemplate(map[string]string{
+								"ira.ontsys.com/trust-anchor":    trustAnchorArn,
+								"ira.ontsys.com/profile":         profileArn,
+								"ira.ontsys.com/role":            roleArn,
+								"ira.ontsys.com/credential-mode": "ecs",
+							}, "my-container"),
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, cronJob)).To(MatchError(ContainSubstring(`spec.jobTemplate.spec.template.metadata.annotations[ira.ontsys.com/credential-mode]: Unsupported value: "ecs"`)))
+		})
+		It("should deny an update that makes the IRA annotations invalid", func() {
+			ctx := context.Background()
+			deployment := newDeployment("invalid-update-deployment", map[string]string{
+				"ira.ontsys.com/trust-anchor": trustAnchorArn,
+				"ira.ontsys.com/profile":      profileArn,
+				"ira.ontsys.com/role":         roleArn,
+			}, "my-container")
+			Expect(k8sClient.Create(ctx, deployment)).To(Succeed())
+
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "invalid-update-deployment"}, deployment)).To(Succeed())
+			deployment.Spec.Template.Annotations["ira.ontsys.com/role"] = "arn:aws:iam::210987654321:role/c"
+			Expect(k8sClient.Update(ctx, deployment)).To(MatchError(ContainSubstring("role is in account 210987654321 but the profile is in account 123456789012")))
+		})
+	})
+})
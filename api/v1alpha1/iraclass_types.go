@@ -0,0 +1,85 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultClassAnnotation marks the IRAClass used by pods that don't select one with ira.ontsys.com/class
+const DefaultClassAnnotation = "ira.ontsys.com/is-default-class"
+
+// IRAClassSpec defines the defaults of an environment for the pods using the class
+type IRAClassSpec struct {
+	// TrustAnchor is the ARN of the IAM Roles Anywhere trust anchor to use for obtaining credentials
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:rolesanywhere:[^:]+:[0-9]{12}:trust-anchor/.+$`
+	// +optional
+	TrustAnchor string `json:"trustAnchor,omitempty"`
+
+	// SessionDuration is the duration, in seconds, of the credentials obtained by the credential helper
+	// +optional
+	SessionDuration string `json:"sessionDuration,omitempty"`
+
+	// Issuer is the cert-manager issuer used by the controller to issue the certificates
+	// +optional
+	Issuer *IssuerReference `json:"issuer,omitempty"`
+
+	// Helper configures the injected credential helper
+	// +optional
+	Helper *ClassHelperSpec `json:"helper,omitempty"`
+}
+
+// ClassHelperSpec configures the injected credential helper
+type ClassHelperSpec struct {
+	// Image is the image containing the rolesanywhere-credential-helper
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// CredentialMode is how the containers obtain credentials from the credential helper
+	// +kubebuilder:validation:Enum=imds;container;process
+	// +optional
+	CredentialMode string `json:"credentialMode,omitempty"`
+
+	// Resources are the CPU and memory requests and limits of the credential helper
+	// +optional
+	Resources *v1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=irac
+
+// IRAClass is the Schema for the iraclasses API
+type IRAClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IRAClassSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IRAClassList contains a list of IRAClass
+type IRAClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IRAClass `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IRAClass{}, &IRAClassList{})
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IRAPolicySpec defines the roles and profiles the pods selected by the policy are allowed to use
+// +kubebuilder:validation:XValidation:rule="!has(self.podSelector) || has(self.namespaceSelector)",message="namespaceSelector is required with podSelector"
+type IRAPolicySpec struct {
+	// NamespaceSelector selects the namespaces of the pods the policy applies to.  All namespaces are selected when it
+	// isn't provided.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ServiceAccounts limits the policy to the pods running as one of the service accounts, given as namespace/name
+	// +kubebuilder:validation:items:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?/[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`
+	// +optional
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+
+	// PodSelector selects the pods the policy applies to.  All pods are selected when it isn't provided.  As the labels
+	// of pods are chosen by their owners, it requires a NamespaceSelector limiting the namespaces it applies to.
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// AllowedRoles are the patterns of the role ARNs the selected pods may use, where * matches any sequence of
+	// characters (e.g. arn:aws:iam::123456789012:role/team-a-*)
+	// +kubebuilder:validation:MinItems=1
+	AllowedRoles []string `json:"allowedRoles"`
+
+	// AllowedProfiles are the patterns of the profile ARNs the selected pods may use.  All profiles are allowed when it
+	// isn't provided.
+	// +optional
+	AllowedProfiles []string `json:"allowedProfiles,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=irapol
+
+// IRAPolicy is the Schema for the irapolicies API
+type IRAPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IRAPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IRAPolicyList contains a list of IRAPolicy
+type IRAPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IRAPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IRAPolicy{}, &IRAPolicyList{})
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IRAProfileSpec defines the IAM Roles Anywhere configuration shared by the pods referencing the profile
+type IRAProfileSpec struct {
+	// TrustAnchor is the ARN of the IAM Roles Anywhere trust anchor to use for obtaining credentials.  When it isn't
+	// provided the trust anchor of the IRAClass used by the pod is used.
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:rolesanywhere:[^:]+:[0-9]{12}:trust-anchor/.+$`
+	// +optional
+	TrustAnchor string `json:"trustAnchor,omitempty"`
+
+	// Profile is the ARN of the IAM Roles Anywhere profile to use for obtaining credentials
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:rolesanywhere:[^:]+:[0-9]{12}:profile/.+$`
+	Profile string `json:"profile"`
+
+	// Role is the ARN of the IAM role to be assumed to gain credentials
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:iam::[0-9]{12}:role/.+$`
+	Role string `json:"role"`
+
+	// SessionDuration is the duration, in seconds, of the credentials obtained by the credential helper
+	// +optional
+	SessionDuration string `json:"sessionDuration,omitempty"`
+
+	// Issuer is the cert-manager issuer used by the controller to issue the certificate
+	// +optional
+	Issuer *IssuerReference `json:"issuer,omitempty"`
+
+	// Helper overrides the configuration of the injected credential helper
+	// +optional
+	Helper *HelperOverrides `json:"helper,omitempty"`
+}
+
+// IssuerReference is a reference to a cert-manager issuer
+type IssuerReference struct {
+	// Kind is the kind of the issuer
+	// +kubebuilder:validation:Enum=ClusterIssuer;Issuer
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Name is the name of the issuer
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// HelperOverrides overrides the defaults of the injected credential helper
+type HelperOverrides struct {
+	// CredentialMode is how the containers obtain credentials from the credential helper
+	// +kubebuilder:validation:Enum=imds;container;process
+	// +optional
+	CredentialMode string `json:"credentialMode,omitempty"`
+
+	// Port is the port the credential helper listens on
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port *int32 `json:"port,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=irap
+
+// IRAProfile is the Schema for the iraprofiles API
+type IRAProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IRAProfileSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IRAProfileList contains a list of IRAProfile
+type IRAProfileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IRAProfile `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IRAProfile{}, &IRAProfileList{})
+}
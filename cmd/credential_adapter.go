@@ -0,0 +1,218 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	v1 "github.com/ontariosystems/ira-controller/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+const (
+	// metadataTokenTTLSeconds is the lifetime of the IMDSv2 session tokens requested from the credential helper, which
+	// are only used for the requests serving a single request of a container
+	metadataTokenTTLSeconds = "60"
+	// adapterRequestTimeout bounds the time spent obtaining credentials from the credential helper
+	adapterRequestTimeout = 10 * time.Second
+)
+
+var adapterLog = ctrl.Log.WithName("credential-adapter")
+
+// credentialAdapter serves the credentials of the IMDSv2 emulation of the credential helper in the format of the
+// container credentials provider (AWS_CONTAINER_CREDENTIALS_FULL_URI), which aws_signing_helper serve doesn't provide.
+// Requests must be authorized with the contents of the token file, which is also mounted in the containers.
+type credentialAdapter struct {
+	client           *http.Client
+	metadataEndpoint string
+	tokenFile        string
+}
+
+// containerCredentials are the credentials in the format expected by the container credentials provider of the SDKs
+type containerCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
+
+// ServeHTTP returns the credentials of the role of the credential helper to authorized requests
+func (a *credentialAdapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	// the token is read for each request as the kubelet rotates it
+	token, err := os.ReadFile(a.tokenFile)
+	if err != nil {
+		adapterLog.Error(err, "unable to read the authorization token")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	credentials, err := a.credentials(r.Context())
+	if err != nil {
+		adapterLog.Error(err, "unable to obtain credentials from the credential helper")
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(credentials); err != nil {
+		adapterLog.Error(err, "unable to write the credentials")
+	}
+}
+
+// credentials obtains the credentials from the credential helper the way the SDKs do from the EC2 instance metadata
+// service: a session token is requested and then used to list the role and get its credentials
+func (a *credentialAdapter) credentials(ctx context.Context) (*containerCredentials, error) {
+	token, err := a.metadata(ctx, http.MethodPut, "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {metadataTokenTTLSeconds}})
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	roles, err := a.metadata(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/", header)
+	if err != nil {
+		return nil, err
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return nil, errors.New("the credential helper didn't return a role")
+	}
+	body, err := a.metadata(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, header)
+	if err != nil {
+		return nil, err
+	}
+	credentials := &containerCredentials{}
+	if err := json.Unmarshal(body, credentials); err != nil {
+		return nil, fmt.Errorf("unable to decode the credentials of the credential helper: %w", err)
+	}
+	return credentials, nil
+}
+
+// metadata sends a request to the metadata endpoint of the credential helper and returns the body of its response
+func (a *credentialAdapter) metadata(ctx context.Context, method string, path string, header http.Header) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.metadataEndpoint, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header = header
+	response, err := a.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned %s", method, path, response.Status)
+	}
+	return body, nil
+}
+
+// probeCredentialAdapter reports an error unless the credential adapter listening on the port returns credentials.  It
+// is run by the startup probe of the credential adapter, as the kubelet's HTTP probes can't reach the loopback
+// interface of the pod.
+func probeCredentialAdapter(ctx context.Context, port int, tokenFile string) error {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/", port), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", string(bytes.TrimSpace(token)))
+	response, err := (&http.Client{Timeout: adapterRequestTimeout}).Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the credential adapter returned %s", response.Status)
+	}
+	return nil
+}
+
+// runCredentialAdapter runs the credential adapter injected in the container credential mode with the arguments
+// following the credential-adapter command and returns the exit code
+func runCredentialAdapter(args []string) int {
+	flags := flag.NewFlagSet(v1.CredentialAdapterCommand, flag.ContinueOnError)
+	port := flags.Int("port", 0, "The port the credential adapter listens on")
+	metadataEndpoint := flags.String("metadata-endpoint", "", "The endpoint of the IMDSv2 emulation of the credential-helper")
+	tokenFile := flags.String("authorization-token-file", "", "The file holding the token authorizing the requests for credentials")
+	probe := flags.Bool("probe", false, "If set, checks that the credential adapter listening on the port returns credentials and exits")
+	opts := zap.Options{}
+	opts.BindFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if *port < 1 || *port > 65535 || *tokenFile == "" || (!*probe && *metadataEndpoint == "") {
+		adapterLog.Error(errors.New("invalid credential adapter arguments"),
+			"Please provide a port between 1 and 65535, the authorization token file and the metadata endpoint")
+		return 1
+	}
+
+	if *probe {
+		if err := probeCredentialAdapter(context.Background(), *port, *tokenFile); err != nil {
+			adapterLog.Error(err, "credential adapter not ready")
+			return 1
+		}
+		return 0
+	}
+
+	server := &http.Server{
+		Addr: fmt.Sprintf("127.0.0.1:%d", *port),
+		Handler: &credentialAdapter{
+			client:           &http.Client{Timeout: adapterRequestTimeout},
+			metadataEndpoint: *metadataEndpoint,
+			tokenFile:        *tokenFile,
+		},
+		ReadHeaderTimeout: adapterRequestTimeout,
+	}
+	ctx := ctrl.SetupSignalHandler()
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+	adapterLog.Info("starting credential adapter", "address", server.Addr, "metadata endpoint", *metadataEndpoint)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		adapterLog.Error(err, "problem running credential adapter")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credential adapter", func() {
+	var (
+		metadata  *httptest.Server
+		adapter   *httptest.Server
+		tokenFile string
+	)
+	BeforeEach(func() {
+		// emulates the IMDSv2 endpoint of aws_signing_helper serve, which requires a session token
+		mux := http.NewServeMux()
+		mux.HandleFunc("PUT /latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("session-token"))
+		})
+		mux.HandleFunc("GET /latest/meta-data/iam/security-credentials/{role...}", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "session-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.PathValue("role") == "" {
+				_, _ = w.Write([]byte("my-role"))
+				return
+			}
+			Expect(r.PathValue("role")).To(Equal("my-role"))
+			_, _ = w.Write([]byte(`{"Code":"Success","Type":"AWS-HMAC","AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"token","Expiration":"2026-10-17T00:00:00Z"}`))
+		})
+		metadata = httptest.NewServer(mux)
+		DeferCleanup(metadata.Close)
+
+		tokenFile = filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte("authorization-token\n"), 0o600)).To(Succeed())
+		adapter = httptest.NewServer(&credentialAdapter{
+			client:           metadata.Client(),
+			metadataEndpoint: metadata.URL,
+			tokenFile:        tokenFile,
+		})
+		DeferCleanup(adapter.Close)
+	})
+	get := func(authorization string) *http.Response {
+		request, err := http.NewRequest(http.MethodGet, adapter.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Authorization", authorization)
+		response, err := adapter.Client().Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(response.Body.Close)
+		return response
+	}
+	It("should serve the credentials in the container credentials format", func() {
+		response := get("authorization-token")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(Equal("application/json"))
+		var body map[string]string
+		Expect(json.NewDecoder(response.Body).Decode(&body)).To(Succeed())
+		Expect(body).To(Equal(map[string]string{
+			"AccessKeyId":     "AKID",
+			"SecretAccessKey": "secret",
+			"Token":           "token",
+			"Expiration":      "2026-10-17T00:00:00Z",
+		}))
+	})
+	It("should reject requests without the authorization token", func() {
+		Expect(get("").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(get("another-token").StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+	It("should fail when the credential helper doesn't return credentials", func() {
+		metadata.Config.Handler = http.NotFoundHandler()
+		Expect(get("authorization-token").StatusCode).To(Equal(http.StatusBadGateway))
+	})
+	It("should pass the probe once credentials are served", func() {
+		address, err := url.Parse(adapter.URL)
+		Expect(err).NotTo(HaveOccurred())
+		port, err := strconv.Atoi(address.Port())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(probeCredentialAdapter(context.Background(), port, tokenFile)).To(Succeed())
+
+		metadata.Config.Handler = http.NotFoundHandler()
+		Expect(probeCredentialAdapter(context.Background(), port, tokenFile)).To(MatchError(ContainSubstring("502")))
+	})
+})
@@ -17,6 +17,7 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
@@ -32,16 +33,23 @@ import (
 	cmv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
 
 	v1 "github.com/ontariosystems/ira-controller/api/v1"
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
 	"github.com/ontariosystems/ira-controller/internal/controller"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -65,11 +73,17 @@ type rootFlags struct {
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(irav1alpha1.AddToScheme(scheme))
 
 	// +kubebuilder:scaffold:scheme
 }
 
 func Execute() {
+	// the credential adapter is shipped in the image of the controller and injected in the container credential mode
+	if len(os.Args) > 1 && os.Args[1] == v1.CredentialAdapterCommand {
+		os.Exit(runCredentialAdapter(os.Args[2:]))
+	}
+
 	mgr, code := configure(addFlags())
 	if code != 0 {
 		os.Exit(code)
@@ -96,6 +110,75 @@ func configure(f *rootFlags) (manager.Manager, int) {
 		return nil, 1
 	}
 
+	if v1.CredentialHelperMode != "" && !slices.Contains(v1.CredentialModes, v1.CredentialHelperMode) {
+		setupLog.Error(errors.New("invalid credential mode"),
+			fmt.Sprintf("Please provide a valid credential mode (%s)", strings.Join(v1.CredentialModes, ",")))
+		return nil, 1
+	}
+
+	if v1.CredentialHelperMode == v1.ContainerMode && v1.CredentialAdapterImage == "" {
+		setupLog.Error(errors.New("credential adapter image not provided"),
+			fmt.Sprintf("Please provide the image of the credential adapter to use the %s credential mode", v1.ContainerMode))
+		return nil, 1
+	}
+
+	if v1.CredentialHelperPort < 1 || v1.CredentialHelperPort > 65535 {
+		setupLog.Error(errors.New("invalid credential helper port"),
+			"Please provide a credential helper port between 1 and 65535")
+		return nil, 1
+	}
+
+	if err := v1.ValidateHelperDefaults(); err != nil {
+		setupLog.Error(err, "Please provide valid credential helper defaults")
+		return nil, 1
+	}
+
+	if err := v1.ValidateRoleSessionNameTemplate(v1.RoleSessionNameTemplate); err != nil {
+		setupLog.Error(err, "Please provide a valid role session name template")
+		return nil, 1
+	}
+
+	if v1.HostNetworkPortRange != "" {
+		if _, _, err := v1.ParsePortRange(v1.HostNetworkPortRange); err != nil {
+			setupLog.Error(err, "Please provide a valid host network port range")
+			return nil, 1
+		}
+	}
+
+	if v1.SidecarMode != "" && !slices.Contains(v1.SidecarModes, v1.SidecarMode) {
+		setupLog.Error(errors.New("invalid sidecar mode"),
+			fmt.Sprintf("Please provide a valid sidecar mode (%s)", strings.Join(v1.SidecarModes, ",")))
+		return nil, 1
+	}
+
+	var sidecarTemplate types.NamespacedName
+	if v1.SidecarTemplate != "" {
+		namespace, name, ok := strings.Cut(v1.SidecarTemplate, "/")
+		if !ok || namespace == "" || name == "" {
+			setupLog.Error(errors.New("invalid sidecar template"),
+				"Please provide the sidecar template ConfigMap in the form namespace/name")
+			return nil, 1
+		}
+		sidecarTemplate = types.NamespacedName{Namespace: namespace, Name: name}
+		if err := loadSidecarTemplate(sidecarTemplate); err != nil {
+			setupLog.Error(err, "unable to load the sidecar template")
+			return nil, 1
+		}
+	}
+
+	if v1.SidecarMode == v1.AutoSidecarMode {
+		native, err := util.NativeSidecarsSupported(util.GetConfig())
+		if err != nil {
+			setupLog.Error(err, "unable to determine whether the cluster supports native sidecars")
+			return nil, 1
+		}
+		v1.SidecarMode = v1.ClassicSidecarMode
+		if native {
+			v1.SidecarMode = v1.NativeSidecarMode
+		}
+		setupLog.Info("detected sidecar mode", "sidecar mode", v1.SidecarMode)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -116,8 +199,20 @@ func configure(f *rootFlags) (manager.Manager, int) {
 		TLSOpts: tlsOpts,
 	})
 
+	// Only the sidecar template ConfigMap is read, so the other ConfigMaps aren't cached
+	cacheOptions := cache.Options{}
+	if v1.SidecarTemplate != "" {
+		cacheOptions.ByObject = map[client.Object]cache.ByObject{
+			&corev1.ConfigMap{}: {
+				Namespaces: map[string]cache.Config{sidecarTemplate.Namespace: {}},
+				Field:      fields.OneTermEqualSelector("metadata.name", sidecarTemplate.Name),
+			},
+		}
+	}
+
 	mgr, err := ctrl.NewManager(util.GetConfig(), ctrl.Options{
 		Scheme: scheme,
+		Cache:  cacheOptions,
 		Metrics: metricsserver.Options{
 			BindAddress:   f.metricsAddr,
 			SecureServing: f.secureMetrics,
@@ -147,6 +242,22 @@ func configure(f *rootFlags) (manager.Manager, int) {
 	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
 		podIraInjector := v1.NewPodIraInjector(mgr.GetClient(), mgr.GetScheme())
 		mgr.GetWebhookServer().Register("/mutate-core-v1-pod", &webhook.Admission{Handler: podIraInjector})
+		podIraValidator := v1.NewPodIraValidator(mgr.GetClient(), mgr.GetScheme())
+		mgr.GetWebhookServer().Register("/validate-core-v1-pod", &webhook.Admission{Handler: podIraValidator})
+		workloadIraValidator := v1.NewWorkloadIraValidator(mgr.GetClient(), mgr.GetScheme())
+		mgr.GetWebhookServer().Register("/validate-workloads", &webhook.Admission{Handler: workloadIraValidator})
+		policyIraValidator := v1.NewPolicyIraValidator(mgr.GetScheme())
+		mgr.GetWebhookServer().Register("/validate-ira-ontsys-com-v1alpha1-irapolicy", &webhook.Admission{Handler: policyIraValidator})
+		if v1.SidecarTemplate != "" {
+			if err = (&controller.SidecarTemplateReconciler{
+				Client:    mgr.GetClient(),
+				Scheme:    mgr.GetScheme(),
+				ConfigMap: sidecarTemplate,
+			}).SetupWithManager(mgr); err != nil {
+				setupLog.Error(err, "unable to create controller", "controller", "SidecarTemplate")
+				return nil, 1
+			}
+		}
 	}
 	if f.generateCert {
 		if err = (&controller.PodReconciler{
@@ -170,6 +281,23 @@ func configure(f *rootFlags) (manager.Manager, int) {
 	return mgr, 0
 }
 
+// loadSidecarTemplate validates the sidecar template ConfigMap so that the controller doesn't start with an invalid
+// template.  Like when it is deleted, a missing ConfigMap leaves the pods without a template until it is created.
+func loadSidecarTemplate(key types.NamespacedName) error {
+	c, err := client.New(util.GetConfig(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(context.Background(), key, configMap); apierrors.IsNotFound(err) {
+		setupLog.Info("sidecar template not found, the sidecar won't be templated until it is created", "sidecar template", key)
+		return v1.LoadSidecarTemplate(nil)
+	} else if err != nil {
+		return err
+	}
+	return v1.LoadSidecarTemplate(configMap)
+}
+
 func addFlags() *rootFlags {
 	var f rootFlags
 	flag.StringVar(&f.metricsAddr, "metrics-bind-address", "0", "The address the metric endpoint binds to. "+
@@ -196,6 +324,58 @@ func addFlags() *rootFlags {
 		"The Memory limit for the credential-helper")
 	flag.StringVar(&v1.SessionDuration, "credential-helper-session-duration", "900",
 		"The number of seconds for which the session is valid")
+	flag.StringVar(&v1.CredentialHelperRegion, "credential-helper-region", "",
+		"The region the credential-helper obtains credentials from. If not set the region of the trust anchor is used")
+	flag.StringVar(&v1.CredentialHelperEndpoint, "credential-helper-endpoint", "",
+		"The IAM Roles Anywhere endpoint used by the credential-helper. If not set the endpoint of the region is used")
+	flag.StringVar(&v1.CredentialHelperEndpoints, "credential-helper-endpoints", "",
+		"A comma separated list of region=endpoint or partition=endpoint pairs (e.g. aws-us-gov=https://rolesanywhere-fips.{region}.amazonaws.com) "+
+			"selecting the IAM Roles Anywhere endpoint of the credential-helper by the region or partition of the trust anchor. "+
+			"{region} is replaced by the region of the credential-helper")
+	flag.StringVar(&v1.RoleSessionNameTemplate, "role-session-name-template", "",
+		"The template of the role session name of the credentials obtained by the credential-helper (e.g. {namespace}.{workload}.{pod}), "+
+			"which may use the {namespace}, {pod}, {service-account} and {workload} placeholders. "+
+			"If not set the serial number of the certificate is used unless a pod provides the ira.ontsys.com/role-session-name annotation")
+	flag.BoolVar(&v1.CredentialHelperWithProxy, "credential-helper-with-proxy", false,
+		"If set, the credential-helper uses the proxy configured by its environment (e.g. HTTPS_PROXY)")
+	flag.BoolVar(&v1.CredentialHelperDebug, "credential-helper-debug", false,
+		"If set, the credential-helper logs debug messages")
+	flag.BoolVar(&v1.CredentialHelperIntermediates, "credential-helper-intermediates", false,
+		"If set, the credential-helper sends the CA certificate of its certificate secret as an intermediate certificate")
+	flag.BoolVar(&v1.CredentialHelperNoVerifySSL, "credential-helper-no-verify-ssl", false,
+		"If set, the credential-helper doesn't verify the TLS certificate of the IAM Roles Anywhere endpoint. Only use this for testing")
+	flag.StringVar(&v1.CredentialHelperMinCpu, "credential-helper-min-cpu", "",
+		"The minimum CPU request or limit pods may set for the credential-helper")
+	flag.StringVar(&v1.CredentialHelperMaxCpu, "credential-helper-max-cpu", "",
+		"The maximum CPU request or limit pods may set for the credential-helper")
+	flag.StringVar(&v1.CredentialHelperMinMemory, "credential-helper-min-memory", "",
+		"The minimum Memory request or limit pods may set for the credential-helper")
+	flag.StringVar(&v1.CredentialHelperMaxMemory, "credential-helper-max-memory", "",
+		"The maximum Memory request or limit pods may set for the credential-helper")
+	flag.IntVar(&v1.MinSessionDuration, "credential-helper-min-session-duration", v1.MinIamSessionDuration,
+		"The minimum number of seconds pods may request for the session")
+	flag.IntVar(&v1.MaxSessionDuration, "credential-helper-max-session-duration", v1.MaxIamSessionDuration,
+		"The maximum number of seconds pods may request for the session")
+	flag.StringVar(&v1.CredentialHelperMode, "credential-helper-mode", v1.ImdsMode,
+		fmt.Sprintf("How containers obtain credentials from the credential-helper (%s)", strings.Join(v1.CredentialModes, ",")))
+	flag.StringVar(&v1.CredentialAdapterImage, "credential-adapter-image", "",
+		fmt.Sprintf("The image of the credential adapter serving credentials to the containers in the %s credential mode, usually the image of the controller. "+
+			"If not set pods can't use the %s credential mode", v1.ContainerMode, v1.ContainerMode))
+	flag.IntVar(&v1.CredentialHelperPort, "credential-helper-port", 9911,
+		"The port the credential-helper listens on unless a pod requests another one or it is already in use")
+	flag.StringVar(&v1.HostNetworkPortRange, "host-network-port-range", "",
+		"The range of ports (e.g. 30000-30999) to allocate credential-helper ports from for pods using the host network. "+
+			"If not set pods using the host network must choose a port with the ira.ontsys.com/port annotation")
+	flag.StringVar(&v1.SidecarMode, "sidecar-mode", v1.AutoSidecarMode,
+		fmt.Sprintf("How the credential-helper sidecar is injected (%s). "+
+			"The auto mode uses native sidecars if the version of the cluster supports them", strings.Join(v1.SidecarModes, ",")))
+	flag.StringVar(&v1.SidecarTemplate, "sidecar-template", "",
+		"The namespace/name of a ConfigMap holding partial container specs that are merged over the credential-helper container. "+
+			"The sidecar.yaml key is used for every pod and the sidecar.<namespace>.yaml keys for the pods of a namespace")
+	flag.BoolVar(&util.TranslateIrsaAnnotations, "translate-irsa-annotations", false,
+		"Use the eks.amazonaws.com/role-arn annotation of a service account as the role of its pods when it doesn't have an ira.ontsys.com/role annotation")
+	flag.BoolVar(&util.EnforceRolePolicies, "enforce-role-policies", false,
+		"Only allow pods to use the roles and profiles allowed by an IRAPolicy selecting them")
 	flag.StringVar(&controller.DefaultIssuerKind, "default-issuer-kind", "ClusterIssuer",
 		"The kind of the cert-manager issuer to use as a default when generating a certificate if one isn't specified")
 	flag.StringVar(&controller.DefaultIssuerName, "default-issuer-name", "",
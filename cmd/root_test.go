@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"encoding/json"
 	"flag"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -9,6 +12,9 @@ import (
 	"github.com/onsi/gomega/gbytes"
 	v1 "github.com/ontariosystems/ira-controller/api/v1"
 	"github.com/ontariosystems/ira-controller/internal/controller"
+	"github.com/ontariosystems/ira-controller/internal/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
 )
 
 var _ = Describe("Cmd configure", func() {
@@ -20,6 +26,15 @@ var _ = Describe("Cmd configure", func() {
 	AfterEach(func() {
 		GinkgoWriter.ClearTeeWriters()
 		v1.CredentialHelperImage = ""
+		v1.CredentialHelperMode = ""
+		v1.CredentialAdapterImage = ""
+		v1.HostNetworkPortRange = ""
+		v1.MaxSessionDuration = v1.MaxIamSessionDuration
+		v1.CredentialHelperRegion = ""
+		v1.CredentialHelperEndpoints = ""
+		v1.RoleSessionNameTemplate = ""
+		v1.SidecarMode = ""
+		v1.SidecarTemplate = ""
 		controller.DefaultIssuerKind = ""
 	})
 	Context("When configuring the root command", func() {
@@ -33,6 +48,7 @@ var _ = Describe("Cmd configure", func() {
 		Context("with an image provided", func() {
 			BeforeEach(func() {
 				v1.CredentialHelperImage = "test:image"
+				v1.CredentialHelperPort = 9911
 			})
 			Context("with an invalid issuer kind", func() {
 				It("should return an error", func() {
@@ -46,10 +62,172 @@ var _ = Describe("Cmd configure", func() {
 					controller.DefaultIssuerKind = "ClusterIssuer"
 				})
 				It("should return the manager", func() {
+					// the pod controller indexes the pods when it is set up, which requires the API server to
+					// discover the pods
+					config := util.GetConfig
+					util.GetConfig = func() *rest.Config {
+						return &rest.Config{Host: discoveryServer().URL}
+					}
+					DeferCleanup(func() {
+						util.GetConfig = config
+					})
 					mgr, rc := configure(&rootFlags{generateCert: true, metricsAddr: "0", probeAddr: ":0"})
 					Expect(mgr).ToNot(BeNil())
 					Expect(rc).To(Equal(0))
 				})
+				It("should return an error when the pods can't be indexed", func() {
+					mgr, rc := configure(&rootFlags{generateCert: true, metricsAddr: "0", probeAddr: ":0"})
+					Expect(mgr).To(BeNil())
+					Expect(rc).To(Equal(1))
+
+					Eventually(func() *gbytes.Buffer {
+						return buffer
+					}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("unable to create controller"))
+				})
+				Context("with an invalid credential mode", func() {
+					It("should return an error", func() {
+						v1.CredentialHelperMode = "invalid"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("invalid credential mode"))
+					})
+				})
+				Context("with the container credential mode without a credential adapter image", func() {
+					It("should return an error", func() {
+						v1.CredentialHelperMode = v1.ContainerMode
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("credential adapter image not provided"))
+					})
+				})
+				Context("with an invalid credential helper port", func() {
+					It("should return an error", func() {
+						v1.CredentialHelperPort = 0
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("invalid credential helper port"))
+					})
+				})
+				Context("with a maximum session duration above the one allowed by IAM", func() {
+					It("should return an error", func() {
+						v1.MaxSessionDuration = 86400
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("Please provide valid credential helper defaults"))
+					})
+				})
+				Context("with an invalid credential helper region", func() {
+					It("should return an error", func() {
+						v1.CredentialHelperRegion = "east"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say(`region \\"east\\" is invalid`))
+					})
+				})
+				Context("with invalid credential helper endpoints", func() {
+					It("should return an error", func() {
+						v1.CredentialHelperEndpoints = "us-gov=https://rolesanywhere.example.com"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("it must be in the form region=endpoint or partition=endpoint"))
+					})
+				})
+				Context("with an invalid role session name template", func() {
+					It("should return an error", func() {
+						v1.RoleSessionNameTemplate = "{namespace}.{pod-name}"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("Please provide a valid role session name template"))
+					})
+				})
+				Context("with an invalid host network port range", func() {
+					It("should return an error", func() {
+						v1.HostNetworkPortRange = "30999-30000"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("Please provide a valid host network port range"))
+					})
+				})
+				Context("with an invalid sidecar mode", func() {
+					It("should return an error", func() {
+						v1.SidecarMode = "invalid"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("invalid sidecar mode"))
+					})
+				})
+				Context("with an invalid sidecar template", func() {
+					It("should return an error", func() {
+						v1.SidecarTemplate = "sidecar-template"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("invalid sidecar template"))
+					})
+				})
+				Context("with a sidecar template that can't be loaded", func() {
+					It("should return an error", func() {
+						v1.SidecarTemplate = "ira-system/sidecar-template"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("unable to load the sidecar template"))
+					})
+				})
+				Context("with the auto sidecar mode when the cluster version can't be determined", func() {
+					It("should return an error", func() {
+						v1.SidecarMode = "auto"
+						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":0"})
+						Expect(mgr).To(BeNil())
+						Expect(rc).To(Equal(1))
+
+						Eventually(func() *gbytes.Buffer {
+							return buffer
+						}, 10*time.Second, 25*time.Millisecond).Should(gbytes.Say("unable to determine whether the cluster supports native sidecars"))
+					})
+				})
 				Context("when provided an invalid health probe address", func() {
 					It("should log a message", func() {
 						mgr, rc := configure(&rootFlags{metricsAddr: "0", probeAddr: ":100000"})
@@ -80,8 +258,47 @@ var _ = Describe("Cmd configure", func() {
 			Expect(flag.Lookup("credential-helper-cpu-limit")).To(HaveField("DefValue", ""))
 			Expect(flag.Lookup("credential-helper-memory-limit")).To(HaveField("DefValue", "128Mi"))
 			Expect(flag.Lookup("credential-helper-session-duration")).To(HaveField("DefValue", "900"))
+			Expect(flag.Lookup("credential-helper-region")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-endpoint")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-endpoints")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("role-session-name-template")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-with-proxy")).To(HaveField("DefValue", "false"))
+			Expect(flag.Lookup("credential-helper-debug")).To(HaveField("DefValue", "false"))
+			Expect(flag.Lookup("credential-helper-intermediates")).To(HaveField("DefValue", "false"))
+			Expect(flag.Lookup("credential-helper-no-verify-ssl")).To(HaveField("DefValue", "false"))
+			Expect(flag.Lookup("credential-helper-min-cpu")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-max-cpu")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-min-memory")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-max-memory")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-min-session-duration")).To(HaveField("DefValue", "900"))
+			Expect(flag.Lookup("credential-helper-max-session-duration")).To(HaveField("DefValue", "43200"))
+			Expect(flag.Lookup("credential-helper-port")).To(HaveField("DefValue", "9911"))
+			Expect(flag.Lookup("host-network-port-range")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("sidecar-mode")).To(HaveField("DefValue", "auto"))
+			Expect(flag.Lookup("sidecar-template")).To(HaveField("DefValue", ""))
+			Expect(flag.Lookup("credential-helper-mode")).To(HaveField("DefValue", "imds"))
 			Expect(flag.Lookup("default-issuer-kind")).To(HaveField("DefValue", "ClusterIssuer"))
 			Expect(flag.Lookup("default-issuer-name")).To(HaveField("DefValue", ""))
 		})
 	})
 })
+
+// discoveryServer returns a server only providing the discovery of the core API group
+func discoveryServer() *httptest.Server {
+	mux := http.NewServeMux()
+	serve := func(path string, body any) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			Expect(json.NewEncoder(w).Encode(body)).To(Succeed())
+		})
+	}
+	serve("/api", &metav1.APIVersions{Versions: []string{"v1"}})
+	serve("/apis", &metav1.APIGroupList{})
+	serve("/api/v1", &metav1.APIResourceList{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: metav1.Verbs{"get", "list", "watch"}}},
+	})
+	server := httptest.NewServer(mux)
+	DeferCleanup(server.Close)
+	return server
+}
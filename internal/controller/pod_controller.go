@@ -18,17 +18,24 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
 	"github.com/ontariosystems/ira-controller/internal/util"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
@@ -39,6 +46,15 @@ var (
 	DefaultCertificateRenewBefore string
 )
 
+const (
+	// classIndex indexes the pods by the IRAClass they select themselves, pods that don't select a class and haven't
+	// opted out are indexed with an empty name as they use the class they inherit or the default class
+	classIndex = "metadata.annotations.class"
+	// profileIndex indexes the pods by the IRAProfile they reference themselves, pods that don't reference a profile and
+	// haven't opted out are indexed with an empty name as they may inherit one
+	profileIndex = "metadata.annotations.profile-ref"
+)
+
 // PodReconciler reconciles a Pod object
 type PodReconciler struct {
 	client.Client
@@ -48,6 +64,8 @@ type PodReconciler struct {
 // +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=pods/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=pods/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
 
 // +kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
@@ -56,6 +74,9 @@ type PodReconciler struct {
 // +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch
 // +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
 // +kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;create;update
+// +kubebuilder:rbac:groups=ira.ontsys.com,resources=iraclasses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=ira.ontsys.com,resources=iraprofiles,verbs=get;list;watch
+// +kubebuilder:rbac:groups=ira.ontsys.com,resources=irapolicies,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -71,7 +92,7 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 
 	pod := &v1.Pod{}
 	err := r.Get(ctx, req.NamespacedName, pod)
-	if errors.IsNotFound(err) {
+	if k8serrors.IsNotFound(err) {
 		rlog.Info("Could not find Pod")
 		return reconcile.Result{}, nil
 	}
@@ -86,6 +107,31 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	}
 
 	rlog.Info("Reconciling Pod")
+	workload, err := util.WorkloadAnnotations(ctx, r.Client, pod.Namespace, pod.OwnerReferences)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	annotations, err := util.ResolveAnnotations(ctx, r.Client, pod.Namespace, util.ServiceAccountName(&pod.Spec), workload, pod.Annotations)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	roles, err := util.AdditionalRoles(annotations)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	roleAnnotations := []map[string]string{annotations}
+	for _, role := range roles {
+		roleAnnotations = append(roleAnnotations, role.Annotations(annotations))
+	}
+	for _, a := range roleAnnotations {
+		if err := util.AuthorizeRole(ctx, r.Client, pod.Namespace, pod, a); errors.Is(err, util.ErrUnauthorized) {
+			rlog.Info("Skipping pod with unauthorized role", "reason", err.Error())
+			return reconcile.Result{}, nil
+		} else if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
 	name, owner := util.ControllerNameFromPod(pod)
 	if owner == nil {
 		owner = metav1.NewControllerRef(&v1.Pod{
@@ -98,24 +144,175 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	}
 
 	issuerKind := DefaultIssuerKind
-	if util.MapContains(pod.Annotations, "ira.ontsys.com/issuer-kind") {
-		issuerKind = pod.Annotations["ira.ontsys.com/issuer-kind"]
+	if util.MapContains(annotations, "ira.ontsys.com/issuer-kind") {
+		issuerKind = annotations["ira.ontsys.com/issuer-kind"]
 	}
 
 	issuerName := DefaultIssuerName
-	if util.MapContains(pod.Annotations, "ira.ontsys.com/issuer-name") {
-		issuerName = pod.Annotations["ira.ontsys.com/issuer-name"]
+	if util.MapContains(annotations, "ira.ontsys.com/issuer-name") {
+		issuerName = annotations["ira.ontsys.com/issuer-name"]
 	}
 
 	certDuration := DefaultCertificateDuration
 	certRenewBefore := DefaultCertificateRenewBefore
 
-	return util.GenerateCertificate(ctx, pod.ObjectMeta.Annotations, name, pod.Namespace, owner, issuerKind, issuerName, certDuration, certRenewBefore)
+	result, err := util.GenerateCertificate(ctx, annotations, name, "", pod.Namespace, owner, issuerKind, issuerName, certDuration, certRenewBefore)
+	if err != nil || !util.MapContains(annotations, "ira.ontsys.com/role") {
+		return result, err
+	}
+	// each additional role is obtained by its own credential helper with its own certificate
+	for _, role := range roles {
+		if result, err = util.GenerateCertificate(ctx, role.Annotations(annotations), name, role.Name, pod.Namespace, owner, issuerKind, issuerName, certDuration, certRenewBefore); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	ctx := context.Background()
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &v1.Pod{}, classIndex, podAnnotationIndex(util.ClassAnnotation)); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &v1.Pod{}, profileIndex, podAnnotationIndex(util.ProfileRefAnnotation)); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1.Pod{}).
+		Watches(&irav1alpha1.IRAProfile{}, handler.EnqueueRequestsFromMapFunc(r.podsForProfile)).
+		Watches(&irav1alpha1.IRAClass{}, handler.EnqueueRequestsFromMapFunc(r.podsForClass)).
+		Watches(&v1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.podsForNamespace), builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&v1.ServiceAccount{}, handler.EnqueueRequestsFromMapFunc(r.podsForServiceAccount), builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&appsv1.DaemonSet{}, handler.EnqueueRequestsFromMapFunc(r.podsForWorkload), builder.OnlyMetadata, builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&appsv1.Deployment{}, handler.EnqueueRequestsFromMapFunc(r.podsForWorkload), builder.OnlyMetadata, builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&appsv1.ReplicaSet{}, handler.EnqueueRequestsFromMapFunc(r.podsForWorkload), builder.OnlyMetadata, builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&appsv1.StatefulSet{}, handler.EnqueueRequestsFromMapFunc(r.podsForWorkload), builder.OnlyMetadata, builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&batchv1.CronJob{}, handler.EnqueueRequestsFromMapFunc(r.podsForWorkload), builder.OnlyMetadata, builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&batchv1.Job{}, handler.EnqueueRequestsFromMapFunc(r.podsForWorkload), builder.OnlyMetadata, builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
 		Complete(r)
 }
+
+// podsForProfile returns a request for each pod using the IRAProfile, either by referencing it or by inheriting the
+// reference from its workload, service account or namespace, so that their certificates are updated when it changes
+func (r *PodReconciler) podsForProfile(ctx context.Context, profile client.Object) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, name := range []string{profile.GetName(), ""} {
+		pods := &v1.PodList{}
+		if err := r.List(ctx, pods, client.InNamespace(profile.GetNamespace()), client.MatchingFields{profileIndex: name}); err != nil {
+			log.FromContext(ctx).Error(err, "unable to list the pods referencing the IRAProfile", "profile", profile.GetName())
+			return nil
+		}
+		for _, pod := range pods.Items {
+			if name != "" || r.inherits(ctx, &pod, util.ProfileRefAnnotation, profile.GetName(), false) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&pod)})
+			}
+		}
+	}
+	return requests
+}
+
+// podsForNamespace returns a request for each pod in the namespace that hasn't opted out so that their certificates
+// are updated when the annotations of the namespace change
+func (r *PodReconciler) podsForNamespace(ctx context.Context, namespace client.Object) []reconcile.Request {
+	pods := &v1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(namespace.GetName())); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list the pods in the namespace", "namespace", namespace.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, pod := range pods.Items {
+		if !util.IsOptedOut(pod.Annotations) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&pod)})
+		}
+	}
+	return requests
+}
+
+// podsForServiceAccount returns a request for each pod running as the service account that hasn't opted out so that
+// their certificates are updated when the annotations of the service account change
+func (r *PodReconciler) podsForServiceAccount(ctx context.Context, serviceAccount client.Object) []reconcile.Request {
+	pods := &v1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(serviceAccount.GetNamespace())); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list the pods running as the service account", "service account", serviceAccount.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, pod := range pods.Items {
+		if util.ServiceAccountName(&pod.Spec) == serviceAccount.GetName() && !util.IsOptedOut(pod.Annotations) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&pod)})
+		}
+	}
+	return requests
+}
+
+// podsForWorkload returns a request for each pod in the namespace of the workload that is controlled by a workload and
+// hasn't opted out so that their certificates are updated when the annotations of their root workload change
+func (r *PodReconciler) podsForWorkload(ctx context.Context, workload client.Object) []reconcile.Request {
+	pods := &v1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(workload.GetNamespace())); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list the pods controlled by the workload", "workload", workload.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, pod := range pods.Items {
+		// The root workload of a pod can only be found by walking its owners, so all the pods controlled by a workload
+		// are reconciled
+		if metav1.GetControllerOf(&pod) != nil && !util.IsOptedOut(pod.Annotations) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&pod)})
+		}
+	}
+	return requests
+}
+
+// podsForClass returns a request for each pod using the IRAClass, either by selecting it, by inheriting the selection
+// from its workload, service account or namespace or by default, so that their certificates are updated when it changes
+func (r *PodReconciler) podsForClass(ctx context.Context, class client.Object) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, name := range []string{class.GetName(), ""} {
+		pods := &v1.PodList{}
+		if err := r.List(ctx, pods, client.MatchingFields{classIndex: name}); err != nil {
+			log.FromContext(ctx).Error(err, "unable to list the pods using the IRAClass", "class", class.GetName())
+			return nil
+		}
+		for _, pod := range pods.Items {
+			if name != "" || r.inherits(ctx, &pod, util.ClassAnnotation, class.GetName(), util.IsDefaultClass(class)) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&pod)})
+			}
+		}
+	}
+	return requests
+}
+
+// inherits reports whether a pod that doesn't select a resource itself inherits the selection of the named resource
+// with the annotation from its workload, service account or namespace, or uses it by default when it doesn't inherit a
+// selection either.  Pods whose selection can't be determined are reported as using the resource so that they are
+// reconciled anyway.
+func (r *PodReconciler) inherits(ctx context.Context, pod *v1.Pod, annotation string, name string, isDefault bool) bool {
+	workload, err := util.WorkloadAnnotations(ctx, r.Client, pod.Namespace, pod.OwnerReferences)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to get the workload of the pod", "pod", client.ObjectKeyFromObject(pod))
+		return true
+	}
+	selected, err := util.SelectedAnnotation(ctx, r.Client, pod.Namespace, util.ServiceAccountName(&pod.Spec), workload, pod.Annotations, annotation)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to get the inherited IRA annotations of the pod", "pod", client.ObjectKeyFromObject(pod))
+		return true
+	}
+	return selected == name || (selected == "" && isDefault)
+}
+
+// podAnnotationIndex returns an index of the pods by the value of the annotation, pods without the annotation that
+// haven't opted out are indexed with an empty value
+func podAnnotationIndex(annotation string) client.IndexerFunc {
+	return func(object client.Object) []string {
+		annotations := object.GetAnnotations()
+		if value, ok := annotations[annotation]; ok {
+			return []string{value}
+		}
+		if util.IsOptedOut(annotations) {
+			return nil
+		}
+		return []string{""}
+	}
+}
@@ -27,6 +27,8 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
+	"github.com/ontariosystems/ira-controller/internal/util"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -192,6 +194,49 @@ var _ = Describe("Pod Controller", func() {
 							Expect(certificate.OwnerReferences[0].Kind).To(Equal("Pod"))
 							Expect(certificate.OwnerReferences[0].Name).To(Equal("annotated"))
 						})
+						Context("when additional roles are requested", func() {
+							It("should create a certificate for each role", func() {
+								ctx := context.Background()
+								pod := &v1.Pod{
+									ObjectMeta: metav1.ObjectMeta{
+										Annotations: map[string]string{
+											"ira.ontsys.com/trust-anchor": "ta",
+											"ira.ontsys.com/profile":      "p",
+											"ira.ontsys.com/role":         "c",
+											"ira.ontsys.com/roles":        `{"backup": {"role": "b", "containers": ["backup-agent"]}}`,
+										},
+										Name:      "roles",
+										Namespace: "default",
+									},
+									Spec: v1.PodSpec{
+										Containers: []v1.Container{
+											{
+												Name:  "my-container",
+												Image: "my-image",
+											},
+											{
+												Name:  "backup-agent",
+												Image: "backup-image",
+											},
+										},
+									},
+								}
+								Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+								certificate := &cmv1.Certificate{}
+								Eventually(func() bool {
+									err := k8sClient.Get(ctx, types.NamespacedName{
+										Namespace: "default",
+										Name:      "roles-ira-backup",
+									}, certificate)
+									return err == nil
+								}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+								Expect(certificate.Spec.SecretName).To(Equal("roles-ira-backup"))
+								Expect(certificate.Spec.CommonName).To(Equal("default/roles/backup"))
+								Expect(certificate.OwnerReferences[0].Name).To(Equal("roles"))
+								Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "roles-ira"}, &cmv1.Certificate{})).To(Succeed())
+							})
+						})
 						Context("when certificate issuer annotations are provided", func() {
 							It("should use the certificate issuer", func() {
 								ctx := context.Background()
@@ -365,6 +410,301 @@ var _ = Describe("Pod Controller", func() {
 							})
 						})
 					})
+					Context("referencing an IRAProfile", func() {
+						It("should use the certificate issuer of the profile", func() {
+							ctx := context.Background()
+							profile := &irav1alpha1.IRAProfile{
+								ObjectMeta: metav1.ObjectMeta{
+									Name:      "profile-issuer",
+									Namespace: "default",
+								},
+								Spec: irav1alpha1.IRAProfileSpec{
+									TrustAnchor: "arn:aws:rolesanywhere:us-east-1:123456789012:trust-anchor/ta",
+									Profile:     "arn:aws:rolesanywhere:us-east-1:123456789012:profile/p",
+									Role:        "arn:aws:iam::123456789012:role/c",
+									Issuer: &irav1alpha1.IssuerReference{
+										Kind: cmv1.IssuerKind,
+										Name: "profile-issuer",
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, profile)).To(Succeed())
+
+							pod := &v1.Pod{
+								ObjectMeta: metav1.ObjectMeta{
+									Annotations: map[string]string{
+										"ira.ontsys.com/profile-ref": "profile-issuer",
+									},
+									Name:      "profile-ref",
+									Namespace: "default",
+								},
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+							certificate := &cmv1.Certificate{}
+							Eventually(func() bool {
+								err := k8sClient.Get(ctx, types.NamespacedName{
+									Namespace: "default",
+									Name:      "profile-ref-ira",
+								}, certificate)
+								return err == nil
+							}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+							Expect(certificate.Spec.IssuerRef.Kind).To(Equal(cmv1.IssuerKind))
+							Expect(certificate.Spec.IssuerRef.Name).To(Equal("profile-issuer"))
+						})
+					})
+					Context("inheriting the reference to an IRAProfile from the namespace", func() {
+						It("should update the certificate when the profile changes", func() {
+							ctx := context.Background()
+							namespace := &v1.Namespace{
+								ObjectMeta: metav1.ObjectMeta{
+									Name: "inherited-profile",
+									Annotations: map[string]string{
+										"ira.ontsys.com/profile-ref": "inherited",
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+							profile := &irav1alpha1.IRAProfile{
+								ObjectMeta: metav1.ObjectMeta{
+									Name:      "inherited",
+									Namespace: "inherited-profile",
+								},
+								Spec: irav1alpha1.IRAProfileSpec{
+									TrustAnchor: "arn:aws:rolesanywhere:us-east-1:123456789012:trust-anchor/ta",
+									Profile:     "arn:aws:rolesanywhere:us-east-1:123456789012:profile/p",
+									Role:        "arn:aws:iam::123456789012:role/c",
+									Issuer: &irav1alpha1.IssuerReference{
+										Kind: cmv1.IssuerKind,
+										Name: "first-issuer",
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, profile)).To(Succeed())
+
+							pod := &v1.Pod{
+								ObjectMeta: metav1.ObjectMeta{
+									Name:      "inherited-profile-ref",
+									Namespace: "inherited-profile",
+								},
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+							certificate := &cmv1.Certificate{}
+							Eventually(func(g Gomega) {
+								g.Expect(k8sClient.Get(ctx, types.NamespacedName{
+									Namespace: "inherited-profile",
+									Name:      "inherited-profile-ref-ira",
+								}, certificate)).To(Succeed())
+								g.Expect(certificate.Spec.IssuerRef.Name).To(Equal("first-issuer"))
+							}, 10*time.Second, 25*time.Millisecond).Should(Succeed())
+
+							profile.Spec.Issuer.Name = "second-issuer"
+							Expect(k8sClient.Update(ctx, profile)).To(Succeed())
+							Eventually(func(g Gomega) {
+								g.Expect(k8sClient.Get(ctx, types.NamespacedName{
+									Namespace: "inherited-profile",
+									Name:      "inherited-profile-ref-ira",
+								}, certificate)).To(Succeed())
+								g.Expect(certificate.Spec.IssuerRef.Name).To(Equal("second-issuer"))
+							}, 10*time.Second, 25*time.Millisecond).Should(Succeed())
+						})
+					})
+					Context("selecting an IRAClass", func() {
+						It("should use the certificate configuration of the class", func() {
+							ctx := context.Background()
+							class := &irav1alpha1.IRAClass{
+								ObjectMeta: metav1.ObjectMeta{
+									Name: "class-issuer",
+								},
+								Spec: irav1alpha1.IRAClassSpec{
+									Issuer: &irav1alpha1.IssuerReference{
+										Kind: cmv1.IssuerKind,
+										Name: "class-issuer",
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, class)).To(Succeed())
+
+							pod := &v1.Pod{
+								ObjectMeta: metav1.ObjectMeta{
+									Annotations: map[string]string{
+										"ira.ontsys.com/class":        "class-issuer",
+										"ira.ontsys.com/trust-anchor": "ta",
+										"ira.ontsys.com/profile":      "p",
+										"ira.ontsys.com/role":         "c",
+									},
+									Name:      "class-ref",
+									Namespace: "default",
+								},
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+							certificate := &cmv1.Certificate{}
+							Eventually(func() bool {
+								err := k8sClient.Get(ctx, types.NamespacedName{
+									Namespace: "default",
+									Name:      "class-ref-ira",
+								}, certificate)
+								return err == nil
+							}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+							Expect(certificate.Spec.IssuerRef.Kind).To(Equal(cmv1.IssuerKind))
+							Expect(certificate.Spec.IssuerRef.Name).To(Equal("class-issuer"))
+						})
+					})
+					Context("provided by the namespace", func() {
+						It("should use the certificate configuration of the namespace", func() {
+							ctx := context.Background()
+							namespace := &v1.Namespace{
+								ObjectMeta: metav1.ObjectMeta{
+									Name: "namespace-defaults",
+									Annotations: map[string]string{
+										"ira.ontsys.com/trust-anchor": "ta",
+										"ira.ontsys.com/profile":      "p",
+										"ira.ontsys.com/role":         "c",
+										"ira.ontsys.com/issuer-name":  "namespace-issuer",
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+
+							pod := &v1.Pod{
+								ObjectMeta: metav1.ObjectMeta{
+									Name:      "namespace-annotated",
+									Namespace: "namespace-defaults",
+								},
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+							certificate := &cmv1.Certificate{}
+							Eventually(func() bool {
+								err := k8sClient.Get(ctx, types.NamespacedName{
+									Namespace: "namespace-defaults",
+									Name:      "namespace-annotated-ira",
+								}, certificate)
+								return err == nil
+							}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+							Expect(certificate.Spec.IssuerRef.Name).To(Equal("namespace-issuer"))
+						})
+					})
+					Context("provided by the service account", func() {
+						It("should use the certificate configuration of the service account", func() {
+							ctx := context.Background()
+							serviceAccount := &v1.ServiceAccount{
+								ObjectMeta: metav1.ObjectMeta{
+									Name:      "service-account-defaults",
+									Namespace: "default",
+									Annotations: map[string]string{
+										"ira.ontsys.com/trust-anchor": "ta",
+										"ira.ontsys.com/profile":      "p",
+										"ira.ontsys.com/role":         "c",
+										"ira.ontsys.com/issuer-name":  "service-account-issuer",
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+
+							pod := &v1.Pod{
+								ObjectMeta: metav1.ObjectMeta{
+									Name:      "service-account-annotated",
+									Namespace: "default",
+								},
+								Spec: v1.PodSpec{
+									ServiceAccountName: "service-account-defaults",
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+							certificate := &cmv1.Certificate{}
+							Eventually(func() bool {
+								err := k8sClient.Get(ctx, types.NamespacedName{
+									Namespace: "default",
+									Name:      "service-account-annotated-ira",
+								}, certificate)
+								return err == nil
+							}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+							Expect(certificate.Spec.IssuerRef.Name).To(Equal("service-account-issuer"))
+						})
+					})
+					Context("when role policies are enforced", func() {
+						BeforeEach(func() {
+							util.EnforceRolePolicies = true
+						})
+						AfterEach(func() {
+							util.EnforceRolePolicies = false
+						})
+						It("should not create a certificate for a role that isn't allowed", func() {
+							ctx := context.Background()
+							pod := &v1.Pod{
+								ObjectMeta: metav1.ObjectMeta{
+									Annotations: map[string]string{
+										"ira.ontsys.com/trust-anchor": "ta",
+										"ira.ontsys.com/profile":      "p",
+										"ira.ontsys.com/role":         "c",
+									},
+									Name:      "unauthorized",
+									Namespace: "default",
+								},
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							}
+							Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+							Eventually(func() *gbytes.Buffer {
+								return buffer
+							}, 5*time.Second, 25*time.Millisecond).Should(gbytes.Say("Skipping pod with unauthorized role"))
+
+							certificate := &cmv1.Certificate{}
+							Expect(k8sClient.Get(ctx, types.NamespacedName{
+								Namespace: "default",
+								Name:      "unauthorized-ira",
+							}, certificate)).To(MatchError(ContainSubstring("not found")))
+						})
+					})
 					Context("using a provided certificate name", func() {
 						It("should create the certificate", func() {
 							ctx := context.Background()
@@ -659,6 +999,84 @@ var _ = Describe("Pod Controller", func() {
 					Expect(certificate.OwnerReferences[0].Name).To(Equal("deploy"))
 				})
 			})
+			Context("with IRA annotations on the deployment", func() {
+				It("should use the certificate configuration of the deployment", func() {
+					ctx := context.Background()
+					deployment := appsv1.Deployment{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"ira.ontsys.com/trust-anchor": "ta",
+								"ira.ontsys.com/profile":      "p",
+								"ira.ontsys.com/role":         "c",
+								"ira.ontsys.com/issuer-name":  "deployment-issuer",
+							},
+							Name:      "annotated-deploy",
+							Namespace: "default",
+						},
+						Spec: appsv1.DeploymentSpec{
+							Selector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{
+									"app": "annotated-app",
+								},
+							},
+							Template: v1.PodTemplateSpec{
+								ObjectMeta: metav1.ObjectMeta{
+									Labels: map[string]string{
+										"app": "annotated-app",
+									},
+								},
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{
+											Name:  "my-container",
+											Image: "my-image",
+										},
+									},
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, &deployment)).To(Succeed())
+
+					pod := &v1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: map[string]string{
+								"app": "annotated-app",
+							},
+							Name:      "annotated-deploy-dkmgf",
+							Namespace: "default",
+							OwnerReferences: []metav1.OwnerReference{
+								{
+									APIVersion: "apps/v1",
+									Controller: &t,
+									Kind:       "Deployment",
+									Name:       deployment.Name,
+									UID:        deployment.UID,
+								},
+							},
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{
+								{
+									Name:  "my-container",
+									Image: "my-image",
+								},
+							},
+						},
+					}
+					Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+					certificate := &cmv1.Certificate{}
+					Eventually(func() bool {
+						err := k8sClient.Get(ctx, types.NamespacedName{
+							Namespace: "default",
+							Name:      "annotated-deploy-deployment-ira",
+						}, certificate)
+						return err == nil
+					}, 10*time.Second, 25*time.Millisecond).Should(BeTrue())
+					Expect(certificate.Spec.IssuerRef.Name).To(Equal("deployment-issuer"))
+				})
+			})
 		})
 	})
 })
@@ -0,0 +1,84 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	webhookv1 "github.com/ontariosystems/ira-controller/api/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// SidecarTemplateReconciler reloads the sidecar template used by the pod webhook when its ConfigMap changes
+type SidecarTemplateReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// ConfigMap is the namespace and name of the sidecar template ConfigMap
+	ConfigMap types.NamespacedName
+}
+
+// The sidecar template ConfigMap is only read in its own namespace, which is the namespace of the controller unless a
+// Role granting access to the ConfigMap is added to another namespace
+// +kubebuilder:rbac:groups="",namespace=system,resources=configmaps,verbs=get;list;watch
+
+// Reconcile loads the sidecar template ConfigMap, keeping the template in use when it is invalid and removing it when
+// the ConfigMap is deleted
+func (r *SidecarTemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	rlog := log.FromContext(ctx)
+
+	configMap := &v1.ConfigMap{}
+	err := r.Get(ctx, req.NamespacedName, configMap)
+	if k8serrors.IsNotFound(err) {
+		rlog.Info("Sidecar template not found: removing it")
+		return reconcile.Result{}, webhookv1.LoadSidecarTemplate(nil)
+	}
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not fetch the sidecar template: %w", err)
+	}
+
+	// Invalid templates won't become valid until the ConfigMap changes again so they aren't retried
+	if err := webhookv1.LoadSidecarTemplate(configMap); err != nil {
+		rlog.Error(err, "Ignoring invalid sidecar template")
+		return reconcile.Result{}, nil
+	}
+	rlog.Info("Reloaded sidecar template")
+	return reconcile.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.  Every replica serves the webhooks, so the controller
+// runs whether or not the replica is the leader.
+func (r *SidecarTemplateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	needLeaderElection := false
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("sidecartemplate").
+		For(&v1.ConfigMap{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+			return client.ObjectKeyFromObject(object) == r.ConfigMap
+		}))).
+		WithOptions(controller.Options{NeedLeaderElection: &needLeaderElection}).
+		Complete(r)
+}
@@ -25,6 +25,7 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
 	"github.com/ontariosystems/ira-controller/internal/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 
@@ -105,6 +106,9 @@ var _ = BeforeSuite(func() {
 	err = cmscheme.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 
+	err = irav1alpha1.AddToScheme(scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	// +kubebuilder:scaffold:scheme
 
 	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
@@ -0,0 +1,307 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// AnnotationPrefix is the prefix of all the IRA annotations
+	AnnotationPrefix = "ira.ontsys.com/"
+	// ClassAnnotation selects the IRAClass providing the defaults of a pod
+	ClassAnnotation = "ira.ontsys.com/class"
+	// ProfileRefAnnotation references the IRAProfile providing the configuration of a pod
+	ProfileRefAnnotation = "ira.ontsys.com/profile-ref"
+	// InjectAnnotation opts a pod out of the injection of the credential helper when set to "false"
+	InjectAnnotation = "ira.ontsys.com/inject"
+	// IrsaRoleAnnotation is the annotation of a service account holding the role of an IAM role for service accounts
+	IrsaRoleAnnotation = "eks.amazonaws.com/role-arn"
+)
+
+// TranslateIrsaAnnotations uses the IRSA role of a service account as the role of its pods
+var TranslateIrsaAnnotations bool
+
+// InheritedAnnotations are the IRA annotations of a namespace, service account or workload that are used by the pods
+// which don't provide their own
+var InheritedAnnotations = []string{
+	"ira.ontsys.com/trust-anchor",
+	"ira.ontsys.com/profile",
+	"ira.ontsys.com/role",
+	"ira.ontsys.com/issuer-kind",
+	"ira.ontsys.com/issuer-name",
+	"ira.ontsys.com/session-duration",
+	"ira.ontsys.com/credential-mode",
+	"ira.ontsys.com/region",
+	"ira.ontsys.com/endpoint",
+	ClassAnnotation,
+	ProfileRefAnnotation,
+}
+
+// ReferenceError is returned when the resource referenced by an annotation can't be retrieved
+type ReferenceError struct {
+	Annotation string
+	Kind       string
+	Name       string
+	Err        error
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("unable to get the %s referenced by %s: %v", e.Kind, e.Annotation, e.Err)
+}
+
+func (e *ReferenceError) Unwrap() error {
+	return e.Err
+}
+
+// ResolveAnnotations returns the effective IRA annotations of a pod (or pod template) controlled by a workload with the
+// workload annotations and running as the service account in the namespace.  The values of the IRAProfile referenced
+// by the ira.ontsys.com/profile-ref annotation are used unless the pod provides its own, the IRA annotations of the
+// workload, then those of the service account and then those of the namespace are used unless the pod or the profile
+// provide them, and the values of the IRAClass selected with ira.ontsys.com/class (or the default class) are used
+// unless any of the others provide them.  Pods without any IRA annotations, either their own or inherited, are left
+// unchanged so that a default class doesn't opt them in, and pods opted out with ira.ontsys.com/inject: "false" have
+// their IRA annotations removed.
+func ResolveAnnotations(ctx context.Context, c client.Reader, namespace string, serviceAccount string, workload map[string]string, annotations map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string)
+	if IsOptedOut(annotations) {
+		for key, value := range annotations {
+			if !strings.HasPrefix(key, AnnotationPrefix) {
+				resolved[key] = value
+			}
+		}
+		return resolved, nil
+	}
+
+	defaults, err := getDefaultAnnotations(ctx, c, namespace, serviceAccount, workload)
+	if err != nil {
+		return nil, err
+	}
+	if !HasIraAnnotations(annotations) && len(defaults) == 0 {
+		maps.Copy(resolved, annotations)
+		return resolved, nil
+	}
+
+	// The class and profile may also be selected by the namespace, the service account or the workload
+	requested := maps.Clone(defaults)
+	maps.Copy(requested, annotations)
+
+	class, err := getClass(ctx, c, requested[ClassAnnotation])
+	if err != nil {
+		return nil, err
+	}
+	if class != nil {
+		maps.Copy(resolved, classAnnotations(class.Spec))
+	}
+	maps.Copy(resolved, defaults)
+
+	if MapContains(requested, ProfileRefAnnotation) {
+		profile := &irav1alpha1.IRAProfile{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: requested[ProfileRefAnnotation]}, profile); err != nil {
+			return nil, &ReferenceError{Annotation: ProfileRefAnnotation, Kind: "IRAProfile", Name: requested[ProfileRefAnnotation], Err: err}
+		}
+		maps.Copy(resolved, profileAnnotations(profile.Spec))
+	}
+	maps.Copy(resolved, annotations)
+	return resolved, nil
+}
+
+// SelectedAnnotation returns the value of an annotation selecting a resource (e.g. the IRAProfile or IRAClass) of a pod
+// (or pod template) controlled by a workload with the workload annotations and running as the service account in the
+// namespace, either its own or the one it inherits from the workload, the service account or the namespace.  It is empty
+// when the pod doesn't select a resource or opted out.
+func SelectedAnnotation(ctx context.Context, c client.Reader, namespace string, serviceAccount string, workload map[string]string, annotations map[string]string, annotation string) (string, error) {
+	if IsOptedOut(annotations) {
+		return "", nil
+	}
+	if value, ok := annotations[annotation]; ok {
+		return value, nil
+	}
+	defaults, err := getDefaultAnnotations(ctx, c, namespace, serviceAccount, workload)
+	if err != nil {
+		return "", err
+	}
+	return defaults[annotation], nil
+}
+
+// getDefaultAnnotations returns the IRA annotations pods inherit from the workload, then from the service account and
+// then from the namespace
+func getDefaultAnnotations(ctx context.Context, c client.Reader, namespace string, serviceAccount string, workload map[string]string) (map[string]string, error) {
+	defaults, err := getNamespaceAnnotations(ctx, c, namespace)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccountDefaults, err := getServiceAccountAnnotations(ctx, c, namespace, serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(defaults, serviceAccountDefaults)
+	maps.Copy(defaults, inheritedAnnotations(workload))
+	return defaults, nil
+}
+
+// IsOptedOut reports whether the pod opted out of the injection of the credential helper, even if its namespace,
+// service account or workload provide IRA annotations
+func IsOptedOut(annotations map[string]string) bool {
+	return annotations[InjectAnnotation] == "false"
+}
+
+// getNamespaceAnnotations returns the IRA annotations of the namespace that pods fall back to
+func getNamespaceAnnotations(ctx context.Context, c client.Reader, name string) (map[string]string, error) {
+	namespace := &v1.Namespace{}
+	if err := c.Get(ctx, client.ObjectKey{Name: name}, namespace); err != nil {
+		return nil, fmt.Errorf("unable to get the namespace %s: %w", name, err)
+	}
+	return inheritedAnnotations(namespace.Annotations), nil
+}
+
+// getServiceAccountAnnotations returns the IRA annotations of the service account that its pods fall back to.  Unless
+// disabled, the IRSA role of the service account is used when it doesn't have a role annotation so that manifests
+// written for EKS can be reused.  A service account that doesn't exist (yet) doesn't provide any annotations.
+func getServiceAccountAnnotations(ctx context.Context, c client.Reader, namespace string, name string) (map[string]string, error) {
+	serviceAccount := &v1.ServiceAccount{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, serviceAccount); k8serrors.IsNotFound(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get the service account %s: %w", name, err)
+	}
+	annotations := inheritedAnnotations(serviceAccount.Annotations)
+	if role, ok := serviceAccount.Annotations[IrsaRoleAnnotation]; ok && TranslateIrsaAnnotations && !MapContains(annotations, "ira.ontsys.com/role") {
+		annotations["ira.ontsys.com/role"] = role
+	}
+	return annotations, nil
+}
+
+// inheritedAnnotations returns the annotations that pods inherit from the annotations of a namespace, service account
+// or workload
+func inheritedAnnotations(annotations map[string]string) map[string]string {
+	inherited := make(map[string]string)
+	for _, annotation := range InheritedAnnotations {
+		if value, ok := annotations[annotation]; ok {
+			inherited[annotation] = value
+		}
+	}
+	return inherited
+}
+
+// HasIraAnnotations reports whether any of the annotations are IRA annotations
+func HasIraAnnotations(annotations map[string]string) bool {
+	for key := range annotations {
+		if strings.HasPrefix(key, AnnotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClass returns the named IRAClass or, when no name is provided, the default class if there is one.  Like the
+// default StorageClass, the most recently created class is used when several are marked as the default.
+func getClass(ctx context.Context, c client.Reader, name string) (*irav1alpha1.IRAClass, error) {
+	if name != "" {
+		class := &irav1alpha1.IRAClass{}
+		if err := c.Get(ctx, client.ObjectKey{Name: name}, class); err != nil {
+			return nil, &ReferenceError{Annotation: ClassAnnotation, Kind: "IRAClass", Name: name, Err: err}
+		}
+		return class, nil
+	}
+
+	classes := &irav1alpha1.IRAClassList{}
+	if err := c.List(ctx, classes); err != nil {
+		return nil, fmt.Errorf("unable to list the IRAClasses: %w", err)
+	}
+	var class *irav1alpha1.IRAClass
+	for i := range classes.Items {
+		if !IsDefaultClass(&classes.Items[i]) {
+			continue
+		}
+		if class == nil || class.CreationTimestamp.Before(&classes.Items[i].CreationTimestamp) {
+			class = &classes.Items[i]
+		}
+	}
+	return class, nil
+}
+
+// IsDefaultClass reports whether the IRAClass is marked as the default class
+func IsDefaultClass(class client.Object) bool {
+	return class.GetAnnotations()[irav1alpha1.DefaultClassAnnotation] == "true"
+}
+
+// classAnnotations returns the annotations equivalent to the configuration in the IRAClass
+func classAnnotations(spec irav1alpha1.IRAClassSpec) map[string]string {
+	annotations := make(map[string]string)
+	setAnnotation(annotations, "ira.ontsys.com/trust-anchor", spec.TrustAnchor)
+	setAnnotation(annotations, "ira.ontsys.com/session-duration", spec.SessionDuration)
+	if spec.Issuer != nil {
+		setAnnotation(annotations, "ira.ontsys.com/issuer-kind", spec.Issuer.Kind)
+		setAnnotation(annotations, "ira.ontsys.com/issuer-name", spec.Issuer.Name)
+	}
+	if spec.Helper != nil {
+		setAnnotation(annotations, "ira.ontsys.com/image", spec.Helper.Image)
+		setAnnotation(annotations, "ira.ontsys.com/credential-mode", spec.Helper.CredentialMode)
+		if spec.Helper.Resources != nil {
+			for annotation, quantity := range map[string]*resource.Quantity{
+				"ira.ontsys.com/cpu-request":    spec.Helper.Resources.Requests.Cpu(),
+				"ira.ontsys.com/cpu-limit":      spec.Helper.Resources.Limits.Cpu(),
+				"ira.ontsys.com/memory-request": spec.Helper.Resources.Requests.Memory(),
+				"ira.ontsys.com/memory-limit":   spec.Helper.Resources.Limits.Memory(),
+			} {
+				if !quantity.IsZero() {
+					annotations[annotation] = quantity.String()
+				}
+			}
+		}
+	}
+	return annotations
+}
+
+// setAnnotation sets the annotation when the value isn't empty
+func setAnnotation(annotations map[string]string, annotation string, value string) {
+	if value != "" {
+		annotations[annotation] = value
+	}
+}
+
+// profileAnnotations returns the annotations equivalent to the configuration in the IRAProfile
+func profileAnnotations(spec irav1alpha1.IRAProfileSpec) map[string]string {
+	annotations := map[string]string{
+		"ira.ontsys.com/profile": spec.Profile,
+		"ira.ontsys.com/role":    spec.Role,
+	}
+	setAnnotation(annotations, "ira.ontsys.com/trust-anchor", spec.TrustAnchor)
+	setAnnotation(annotations, "ira.ontsys.com/session-duration", spec.SessionDuration)
+	if spec.Issuer != nil {
+		setAnnotation(annotations, "ira.ontsys.com/issuer-kind", spec.Issuer.Kind)
+		setAnnotation(annotations, "ira.ontsys.com/issuer-name", spec.Issuer.Name)
+	}
+	if spec.Helper != nil {
+		setAnnotation(annotations, "ira.ontsys.com/credential-mode", spec.Helper.CredentialMode)
+		if spec.Helper.Port != nil {
+			annotations["ira.ontsys.com/port"] = strconv.Itoa(int(*spec.Helper.Port))
+		}
+	}
+	return annotations
+}
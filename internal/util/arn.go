@@ -0,0 +1,65 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	partitionPattern = regexp.MustCompile(`^aws(-[a-z]+)*$`)
+	accountPattern   = regexp.MustCompile(`^[0-9]{12}$`)
+)
+
+// Arn is a parsed Amazon Resource Name
+type Arn struct {
+	Partition string
+	Service   string
+	Region    string
+	AccountID string
+	Resource  string
+}
+
+// ParseArn parses an Amazon Resource Name in the form arn:partition:service:region:account-id:resource
+func ParseArn(arn string) (Arn, error) {
+	sections := strings.SplitN(arn, ":", 6)
+	if len(sections) != 6 || sections[0] != "arn" {
+		return Arn{}, fmt.Errorf("%q is not an ARN", arn)
+	}
+	parsed := Arn{
+		Partition: sections[1],
+		Service:   sections[2],
+		Region:    sections[3],
+		AccountID: sections[4],
+		Resource:  sections[5],
+	}
+	if !partitionPattern.MatchString(parsed.Partition) {
+		return Arn{}, fmt.Errorf("%q has an invalid partition %q", arn, parsed.Partition)
+	}
+	if !accountPattern.MatchString(parsed.AccountID) {
+		return Arn{}, fmt.Errorf("%q has an invalid account ID %q", arn, parsed.AccountID)
+	}
+	return parsed, nil
+}
+
+// ResourceType returns the type of the resource (e.g. role for arn:aws:iam::123456789012:role/name)
+func (a Arn) ResourceType() string {
+	resourceType, _, _ := strings.Cut(a.Resource, "/")
+	return resourceType
+}
@@ -41,12 +41,13 @@ func GetCertName(podAnnotations map[string]string, resourceControllerName string
 	return
 }
 
-// GenerateCertificate creates/updates a certificate resource to be used for authentication
-func GenerateCertificate(ctx context.Context, annotations map[string]string, name string, namespace string, ownerReference *metav1.OwnerReference, issuerKind string, issuerName string, certDuration string, certRenewBefore string) (ctrl.Result, error) {
+// GenerateCertificate creates/updates a certificate resource to be used for authentication, either for the primary role
+// of the resource (an empty role name) or for one of its additional roles
+func GenerateCertificate(ctx context.Context, annotations map[string]string, name string, role string, namespace string, ownerReference *metav1.OwnerReference, issuerKind string, issuerName string, certDuration string, certRenewBefore string) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 	if MapContains(annotations, "ira.ontsys.com/trust-anchor") && MapContains(annotations, "ira.ontsys.com/profile") && MapContains(annotations, "ira.ontsys.com/role") {
-		log.Info("Found resource with annotations", "controller name", name)
-		certName := GetCertName(annotations, name)
+		log.Info("Found resource with annotations", "controller name", name, "role", role)
+		certName := RoleCertName(GetCertName(annotations, name), role)
 		config := GetConfig()
 		clientset, err := cmclient.NewForConfig(config)
 		if err != nil {
@@ -60,7 +61,7 @@ func GenerateCertificate(ctx context.Context, annotations map[string]string, nam
 				Namespace: namespace,
 			},
 			Spec: cmv1.CertificateSpec{
-				CommonName: getCommonName(name, namespace),
+				CommonName: getCommonName(name, namespace, role),
 				IssuerRef: cmmeta.ObjectReference{
 					Name:  issuerName,
 					Kind:  issuerKind,
@@ -116,10 +117,16 @@ func GenerateCertificate(ctx context.Context, annotations map[string]string, nam
 	return ctrl.Result{}, nil
 }
 
-func getCommonName(name string, namespace string) string {
+// getCommonName returns the common name of the certificate, which is suffixed with the name of an additional role so
+// that it isn't truncated away
+func getCommonName(name string, namespace string, role string) string {
 	commonName := fmt.Sprintf("%s/%s", namespace, name)
-	if len(commonName) < 65 {
-		return commonName
+	suffix := ""
+	if role != "" {
+		suffix = "/" + role
 	}
-	return commonName[:64]
+	if len(commonName)+len(suffix) < 65 {
+		return commonName + suffix
+	}
+	return commonName[:64-len(suffix)] + suffix
 }
@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"slices"
 	"strings"
 
@@ -40,34 +41,71 @@ func ControllerNameFromPod(pod *v1.Pod) (string, *metav1.OwnerReference) {
 	if err != nil {
 		panic(errors.New("could not get client"))
 	}
-	owner := getRootOwner(client.NewNamespacedClient(c, pod.Namespace), pod.OwnerReferences)
+	owner, _, err := getRootOwner(context.Background(), c, pod.Namespace, pod.OwnerReferences)
+	if err != nil {
+		panic(errors.New("could not get owner"))
+	}
 	if owner != nil {
 		return fmt.Sprintf("%s-%s", owner.Name, strings.ToLower(owner.Kind)), owner
 	}
 	return pod.Name, nil
 }
 
-func getRootOwner(c client.Client, owners []metav1.OwnerReference) *metav1.OwnerReference {
+// WorkloadAnnotations returns the annotations of the root workload controlling an object with the owner references,
+// or nil if the object isn't controlled by a workload
+func WorkloadAnnotations(ctx context.Context, c client.Reader, namespace string, owners []metav1.OwnerReference) (map[string]string, error) {
+	owner, workload, err := getRootOwner(ctx, c, namespace, owners)
+	if err != nil || owner == nil {
+		return nil, err
+	}
+	annotations := make(map[string]string)
+	maps.Copy(annotations, workload.GetAnnotations())
+	return annotations, nil
+}
+
+// WorkloadName returns the name of the root workload controlling an object with the owner references, or an empty
+// string if the object isn't controlled by a workload
+func WorkloadName(ctx context.Context, c client.Reader, namespace string, owners []metav1.OwnerReference) (string, error) {
+	owner, _, err := getRootOwner(ctx, c, namespace, owners)
+	if err != nil || owner == nil {
+		return "", err
+	}
+	return owner.Name, nil
+}
+
+func getRootOwner(ctx context.Context, c client.Reader, namespace string, owners []metav1.OwnerReference) (*metav1.OwnerReference, *unstructured.Unstructured, error) {
 	for _, owner := range owners {
 		plog.Info("Processing owner reference", "owner", owner)
-		if *owner.Controller && slices.Contains([]string{"CronJob", "DaemonSet", "Deployment", "Job", "ReplicaSet", "StatefulSet"}, owner.Kind) {
+		if owner.Controller != nil && *owner.Controller && slices.Contains([]string{"CronJob", "DaemonSet", "Deployment", "Job", "ReplicaSet", "StatefulSet"}, owner.Kind) {
 			u := &unstructured.Unstructured{}
 			u.SetGroupVersionKind(schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind))
-			if err := c.Get(context.Background(), client.ObjectKey{
-				Name: owner.Name,
+			if err := c.Get(ctx, client.ObjectKey{
+				Namespace: namespace,
+				Name:      owner.Name,
 			}, u); k8serrors.IsNotFound(err) {
 				plog.Info("Owner not found", "owner", owner.Name)
-				return nil
+				return nil, nil, nil
 			} else if err != nil {
-				panic(errors.New("could not get owner"))
+				return nil, nil, fmt.Errorf("unable to get the owner %s %s: %w", owner.Kind, owner.Name, err)
+			}
+			parent, parentWorkload, err := getRootOwner(ctx, c, namespace, u.GetOwnerReferences())
+			if err != nil {
+				return nil, nil, err
 			}
-			parent := getRootOwner(c, u.GetOwnerReferences())
 			if parent == nil {
-				return &owner
+				return &owner, u, nil
 			} else {
-				return parent
+				return parent, parentWorkload, nil
 			}
 		}
 	}
-	return nil
+	return nil, nil, nil
+}
+
+// ServiceAccountName returns the name of the service account the pod runs as
+func ServiceAccountName(spec *v1.PodSpec) string {
+	if spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return spec.ServiceAccountName
 }
@@ -0,0 +1,179 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	irav1alpha1 "github.com/ontariosystems/ira-controller/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// EnforceRolePolicies denies the pods whose role or profile isn't allowed by an IRAPolicy
+	EnforceRolePolicies bool
+
+	// ErrUnauthorized is returned when no IRAPolicy allows the role or profile of a pod
+	ErrUnauthorized = errors.New("not authorized by any IRAPolicy")
+)
+
+// AuthorizeRole returns an error wrapping ErrUnauthorized unless an IRAPolicy selecting the pod allows both its role
+// and its profile.  The namespace is passed separately as it isn't set on pods being created.  Every pod is authorized when policies aren't enforced.
+func AuthorizeRole(ctx context.Context, c client.Reader, namespaceName string, pod *v1.Pod, annotations map[string]string) error {
+	if !EnforceRolePolicies {
+		return nil
+	}
+	role := annotations["ira.ontsys.com/role"]
+	profile := annotations["ira.ontsys.com/profile"]
+	if role == "" {
+		return nil
+	}
+
+	namespace := &v1.Namespace{}
+	if err := c.Get(ctx, client.ObjectKey{Name: namespaceName}, namespace); err != nil {
+		return fmt.Errorf("unable to get the namespace of the pod: %w", err)
+	}
+	policies := &irav1alpha1.IRAPolicyList{}
+	if err := c.List(ctx, policies); err != nil {
+		return fmt.Errorf("unable to list the IRAPolicies: %w", err)
+	}
+
+	serviceAccount := namespaceName + "/" + ServiceAccountName(&pod.Spec)
+	current := make(map[types.UID]struct{}, len(policies.Items))
+	defer pruneCompiledPolicies(current)
+	for _, policy := range policies.Items {
+		current[policy.UID] = struct{}{}
+		compiled, err := compiledPolicyOf(&policy)
+		if err != nil {
+			return fmt.Errorf("invalid IRAPolicy %s: %w", policy.Name, err)
+		}
+		if !compiled.selects(namespace, serviceAccount, pod) || !compiled.roles.MatchString(role) {
+			continue
+		}
+		if compiled.profiles == nil || compiled.profiles.MatchString(profile) {
+			return nil
+		}
+	}
+	return fmt.Errorf("role %s with profile %s for service account %s is %w", role, profile, serviceAccount, ErrUnauthorized)
+}
+
+// ValidatePolicy returns the errors of the selectors and patterns of an IRAPolicy, which would otherwise only be
+// reported when authorizing pods
+func ValidatePolicy(spec irav1alpha1.IRAPolicySpec, path *field.Path) field.ErrorList {
+	_, errs := compilePolicy(spec, path)
+	return errs
+}
+
+// compiledPolicy holds the selectors and patterns of an IRAPolicy parsed once per generation of the policy
+type compiledPolicy struct {
+	generation        int64
+	namespaceSelector labels.Selector
+	serviceAccounts   []string
+	podSelector       labels.Selector
+	roles             *regexp.Regexp
+	// profiles is nil when all profiles are allowed
+	profiles *regexp.Regexp
+	err      error
+}
+
+// compiledPolicies caches the compiled IRAPolicies by UID
+var compiledPolicies sync.Map
+
+// compiledPolicyOf returns the cached compilation of the policy, compiling it when it changed
+func compiledPolicyOf(policy *irav1alpha1.IRAPolicy) (*compiledPolicy, error) {
+	if cached, ok := compiledPolicies.Load(policy.UID); ok && cached.(*compiledPolicy).generation == policy.Generation {
+		compiled := cached.(*compiledPolicy)
+		return compiled, compiled.err
+	}
+	compiled, errs := compilePolicy(policy.Spec, field.NewPath("spec"))
+	compiled.generation = policy.Generation
+	compiled.err = errs.ToAggregate()
+	compiledPolicies.Store(policy.UID, compiled)
+	return compiled, compiled.err
+}
+
+// pruneCompiledPolicies removes the compilations of the policies that no longer exist from the cache
+func pruneCompiledPolicies(current map[types.UID]struct{}) {
+	compiledPolicies.Range(func(key, _ any) bool {
+		if _, ok := current[key.(types.UID)]; !ok {
+			compiledPolicies.Delete(key)
+		}
+		return true
+	})
+}
+
+func compilePolicy(spec irav1alpha1.IRAPolicySpec, path *field.Path) (*compiledPolicy, field.ErrorList) {
+	var errs field.ErrorList
+	compiled := &compiledPolicy{serviceAccounts: spec.ServiceAccounts}
+	for _, selection := range []struct {
+		selector *metav1.LabelSelector
+		compiled *labels.Selector
+		path     *field.Path
+	}{
+		{spec.NamespaceSelector, &compiled.namespaceSelector, path.Child("namespaceSelector")},
+		{spec.PodSelector, &compiled.podSelector, path.Child("podSelector")},
+	} {
+		if selection.selector == nil {
+			*selection.compiled = labels.Everything()
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(selection.selector)
+		if err != nil {
+			errs = append(errs, field.Invalid(selection.path, selection.selector, err.Error()))
+			continue
+		}
+		*selection.compiled = selector
+	}
+	var err error
+	if compiled.roles, err = compileArnPatterns(spec.AllowedRoles); err != nil {
+		errs = append(errs, field.Invalid(path.Child("allowedRoles"), spec.AllowedRoles, err.Error()))
+	}
+	if len(spec.AllowedProfiles) > 0 {
+		if compiled.profiles, err = compileArnPatterns(spec.AllowedProfiles); err != nil {
+			errs = append(errs, field.Invalid(path.Child("allowedProfiles"), spec.AllowedProfiles, err.Error()))
+		}
+	}
+	return compiled, errs
+}
+
+// compileArnPatterns returns a regular expression matching the ARNs matching any of the patterns, where * matches any
+// sequence of characters
+func compileArnPatterns(patterns []string) (*regexp.Regexp, error) {
+	exprs := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		exprs = append(exprs, strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*"))
+	}
+	return regexp.Compile("^(?:" + strings.Join(exprs, "|") + ")$")
+}
+
+func (p *compiledPolicy) selects(namespace *v1.Namespace, serviceAccount string, pod *v1.Pod) bool {
+	if len(p.serviceAccounts) > 0 && !slices.Contains(p.serviceAccounts, serviceAccount) {
+		return false
+	}
+	return p.namespaceSelector.Matches(labels.Set(namespace.Labels)) && p.podSelector.Matches(labels.Set(pod.Labels))
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// RolesAnnotation maps the names of additional roles of a pod to the role, the optional profile and the containers
+	// using each of them as a JSON object, e.g. {"backup": {"role": "arn:...", "containers": ["backup-agent"]}}
+	RolesAnnotation = "ira.ontsys.com/roles"
+
+	// maxRoleNameLength keeps the names derived from the name of an additional role (e.g. the ira-cert-<name> volume)
+	// within the 63 characters allowed by Kubernetes
+	maxRoleNameLength = 54
+)
+
+// roleNamePattern matches the names of additional roles, which are used in the names of containers and volumes
+var roleNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// AdditionalRole is a role, in addition to the one of the ira.ontsys.com/role annotation, obtained by its own credential
+// helper for the containers of the pod mapped to it
+type AdditionalRole struct {
+	Name       string   `json:"-"`
+	Role       string   `json:"role"`
+	Profile    string   `json:"profile,omitempty"`
+	Containers []string `json:"containers"`
+}
+
+// AdditionalRoles parses the additional roles of the ira.ontsys.com/roles annotation, sorted by name, and verifies that
+// each of them has a valid name, a role and containers which aren't mapped to any other role
+func AdditionalRoles(annotations map[string]string) ([]AdditionalRole, error) {
+	value, ok := annotations[RolesAnnotation]
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	parsed := make(map[string]AdditionalRole)
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		return nil, fmt.Errorf("%s must be a JSON object mapping role names to a role, an optional profile and containers: %w", RolesAnnotation, err)
+	}
+
+	var roles []AdditionalRole
+	mapped := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(parsed)) {
+		role := parsed[name]
+		role.Name = name
+		if len(name) > maxRoleNameLength || !roleNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("role name %q in %s is invalid, it must consist of at most %d lower case alphanumeric characters or '-'", name, RolesAnnotation, maxRoleNameLength)
+		}
+		if role.Role == "" {
+			return nil, fmt.Errorf("role %q in %s is missing its role", name, RolesAnnotation)
+		}
+		if len(role.Containers) == 0 {
+			return nil, fmt.Errorf("role %q in %s must list the containers using it", name, RolesAnnotation)
+		}
+		for _, container := range role.Containers {
+			if other, ok := mapped[container]; ok {
+				return nil, fmt.Errorf("container %q in %s is mapped to both role %q and role %q", container, RolesAnnotation, other, name)
+			}
+			mapped[container] = name
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// AdditionalRoleContainers returns the names of the containers mapped to an additional role, ignoring an invalid
+// ira.ontsys.com/roles annotation
+func AdditionalRoleContainers(annotations map[string]string) []string {
+	roles, _ := AdditionalRoles(annotations)
+	var containers []string
+	for _, role := range roles {
+		containers = append(containers, role.Containers...)
+	}
+	return containers
+}
+
+// Annotations returns the IRA annotations of the additional role, which are those of the pod with the role and, if the
+// additional role has one, the profile replaced
+func (r AdditionalRole) Annotations(annotations map[string]string) map[string]string {
+	roleAnnotations := maps.Clone(annotations)
+	delete(roleAnnotations, RolesAnnotation)
+	roleAnnotations["ira.ontsys.com/role"] = r.Role
+	if r.Profile != "" {
+		roleAnnotations["ira.ontsys.com/profile"] = r.Profile
+	}
+	return roleAnnotations
+}
+
+// RoleCertName returns the name of the certificate/secret of the additional role from the name of the certificate of
+// the pod, the name of the certificate of the pod is returned for its primary role (an empty role name)
+func RoleCertName(certName string, role string) string {
+	if role == "" {
+		return certName
+	}
+	return certName + "-" + role
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 Ontario Systems.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// nativeSidecarsVersion is the first Kubernetes version with native sidecar containers enabled by default
+var nativeSidecarsVersion = version.MustParseGeneric("1.29.0")
+
+// NativeSidecarsSupported checks the version of the API server to determine whether native sidecar containers (init
+// containers with a restart policy of Always) are available
+func NativeSidecarsSupported(config *rest.Config) (bool, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return false, err
+	}
+	info, err := client.ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	serverVersion, err := version.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return false, err
+	}
+	return serverVersion.AtLeast(nativeSidecarsVersion), nil
+}